@@ -0,0 +1,58 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+)
+
+//+kubebuilder:object:root=true
+
+// ProjectConfig is the configuration file of the manager, loaded with --config
+type ProjectConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ControllerManagerConfigurationSpec returns the configurations for controllers
+	cfg.ControllerManagerConfigurationSpec `json:",inline"`
+
+	// FeatureGates turns features on or off by name, --feature-gates takes precedence
+	// +optional
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+
+	// Labels configures the keys of the labels the controller manages
+	// +optional
+	Labels *LabelsConfig `json:"labels,omitempty"`
+}
+
+// LabelsConfig configures the keys of the labels the controller manages
+type LabelsConfig struct {
+	// Prefix of the managed label keys, e.g. <prefix>/podset. Defaults to app.github.com.
+	// Pods labelled with a different prefix are no longer found after changing it.
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// LegacySelection also selects the pods carrying only the unprefixed app label
+	// they were created with before the keys were prefixed, until they are relabelled.
+	// It is meant to be turned on for the migration only. Defaults to false.
+	// +optional
+	LegacySelection *bool `json:"legacySelection,omitempty"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ProjectConfig{})
+}
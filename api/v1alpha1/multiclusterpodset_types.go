@@ -0,0 +1,152 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MultiClusterPodSetSpec defines the desired state of MultiClusterPodSet
+type MultiClusterPodSetSpec struct {
+	// Replicas is the total number of pods across all member clusters
+	Replicas int32 `json:"replicas"`
+
+	// Template is the spec of the PodSets created in the member clusters, their
+	// replica counts are set by the operator. It is validated by the member clusters.
+	//+kubebuilder:validation:Schemaless
+	//+kubebuilder:pruning:PreserveUnknownFields
+	//+kubebuilder:validation:Type=object
+	Template PodSetSpec `json:"template"`
+
+	// Clusters are the member clusters the replicas are distributed across
+	//+kubebuilder:validation:MinItems=1
+	Clusters []MemberCluster `json:"clusters"`
+
+	// UnhealthyTimeoutSeconds is how long a member cluster may be unreachable or
+	// run fewer ready pods than assigned before its replicas are moved to the
+	// other clusters. The cluster is given its share back after the same amount
+	// of time. Defaults to 300.
+	// +optional
+	//+kubebuilder:validation:Minimum=1
+	UnhealthyTimeoutSeconds *int32 `json:"unhealthyTimeoutSeconds,omitempty"`
+}
+
+// MemberCluster is a cluster a MultiClusterPodSet places a PodSet in
+type MemberCluster struct {
+	// Name identifies the cluster
+	Name string `json:"name"`
+
+	// KubeconfigSecret is the Secret, in the namespace of the MultiClusterPodSet,
+	// holding the kubeconfig used to connect to the cluster
+	KubeconfigSecret KubeconfigSecretReference `json:"kubeconfigSecret"`
+
+	// Weight is the share of the replicas the cluster should run, relative to
+	// the weights of the other clusters
+	//+kubebuilder:validation:Minimum=0
+	Weight int32 `json:"weight"`
+
+	// Namespace is where the PodSet is created in the member cluster, defaults to
+	// the namespace of the MultiClusterPodSet
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// KubeconfigSecretReference points to a kubeconfig stored in a Secret
+type KubeconfigSecretReference struct {
+	Name string `json:"name"`
+
+	// Key of the kubeconfig in the Secret's data, defaults to "kubeconfig"
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// MultiClusterPodSetStatus defines the observed state of MultiClusterPodSet
+type MultiClusterPodSetStatus struct {
+	// Replicas is the number of pods reported by all member PodSets
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// ReadyReplicas is the number of ready pods reported by all member PodSets
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// Clusters is the observed state of every member cluster
+	// +optional
+	Clusters []MemberClusterStatus `json:"clusters,omitempty"`
+}
+
+// MemberClusterStatus is the observed state of one member cluster
+type MemberClusterStatus struct {
+	Name string `json:"name"`
+
+	// Healthy tells whether the cluster currently gets its share of the replicas
+	Healthy bool `json:"healthy"`
+
+	// AssignedReplicas is the replica count of the cluster's PodSet
+	AssignedReplicas int32 `json:"assignedReplicas"`
+
+	// Replicas is the number of pods the cluster's PodSet reports
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// ReadyReplicas is the number of ready pods the cluster's PodSet reports
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// ShortSince is set while the cluster runs fewer ready pods than assigned, e.g. during a
+	// rollout. The cluster is only degraded once it has been short for a minute.
+	// +optional
+	ShortSince *metav1.Time `json:"shortSince,omitempty"`
+
+	// DegradedSince is set while the cluster is unreachable or has been running fewer ready
+	// pods than assigned for too long
+	// +optional
+	DegradedSince *metav1.Time `json:"degradedSince,omitempty"`
+
+	// UnhealthySince is set while the cluster's replicas are moved to the other clusters
+	// +optional
+	UnhealthySince *metav1.Time `json:"unhealthySince,omitempty"`
+
+	// Message explains why the cluster is degraded
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// MultiClusterPodSet is the Schema for the multiclusterpodsets API
+type MultiClusterPodSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MultiClusterPodSetSpec   `json:"spec,omitempty"`
+	Status MultiClusterPodSetStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MultiClusterPodSetList contains a list of MultiClusterPodSet
+type MultiClusterPodSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MultiClusterPodSet `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MultiClusterPodSet{}, &MultiClusterPodSetList{})
+}
@@ -17,6 +17,12 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"encoding/json"
+	"strconv"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -29,6 +35,432 @@ type PodSetSpec struct {
 	// Important: Run "make" to regenerate code after modifying this file
 
 	Replicas int32 `json:"replicas"`
+
+	// PlacementMode is Replicas to run spec.replicas pods, or PerNode to run one pod on every
+	// node matching NodeSelector, in which case the replica count, capacity mix and node pools
+	// are ignored
+	// +optional
+	//+kubebuilder:default=Replicas
+	PlacementMode PlacementMode `json:"placementMode,omitempty"`
+
+	// NodeSelector picks the nodes a PerNode PodSet runs a pod on, on top of the node selector
+	// and tolerations of the template. Every node when empty.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// MaxPerNode caps the number of pods of a Replicas PodSet running on the same node
+	// +optional
+	//+kubebuilder:validation:Minimum=1
+	MaxPerNode *int32 `json:"maxPerNode,omitempty"`
+
+	// TemporaryScale overrides the replica count until it expires, e.g. for a load test.
+	// It is cleared once it has expired and the replica count reverts to Replicas.
+	// +optional
+	TemporaryScale *TemporaryScale `json:"temporaryScale,omitempty"`
+
+	// Version is the application version the pods are labelled with. It isn't
+	// part of the selector, changing it relabels the running pods in place.
+	// Defaults to v0.1, the version pods were labelled with before it could be set.
+	// It has to be a valid label value.
+	// +optional
+	//+kubebuilder:default=v0.1
+	//+kubebuilder:validation:MaxLength=63
+	//+kubebuilder:validation:Pattern=`^(([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9])?$`
+	Version string `json:"version,omitempty"`
+
+	// Template describes the pods that will be created, a single busybox
+	// container is run when it is left empty. Changing it rolls the pods out
+	// to a new revision.
+	// +optional
+	Template *corev1.PodTemplateSpec `json:"template,omitempty"`
+
+	// Strategy configures how pods are replaced when the template changes
+	// +optional
+	Strategy *RolloutStrategy `json:"strategy,omitempty"`
+
+	// Hooks are Jobs run around the rollout of a new template revision
+	// +optional
+	Hooks *RolloutHooks `json:"hooks,omitempty"`
+
+	// RevisionHistoryLimit is the number of template revisions kept around for
+	// inspection. Defaults to 10.
+	// +optional
+	//+kubebuilder:validation:Minimum=1
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+
+	// CapacityMix spreads the replicas over several node-selector/toleration
+	// variants (e.g. spot and on-demand nodes) according to their weights
+	// +optional
+	CapacityMix *CapacityMix `json:"capacityMix,omitempty"`
+
+	// NodePools is an ordered list of pools the pods are placed on. All pods go
+	// to the first pool that has capacity, pods that stay unschedulable fall back
+	// to the next pool and are migrated back once the preferred pool has capacity
+	// again. Ignored when CapacityMix is set.
+	// +optional
+	NodePools []NodePool `json:"nodePools,omitempty"`
+
+	// ScaleDown configures how pods are picked for removal
+	// +optional
+	ScaleDown *ScaleDownPolicy `json:"scaleDown,omitempty"`
+
+	// CapacityCheck estimates whether new pods fit on the cluster's nodes before
+	// creating them
+	// +optional
+	CapacityCheck *CapacityCheck `json:"capacityCheck,omitempty"`
+
+	// CreatorServiceAccount is a ServiceAccount in the PodSet's namespace the operator
+	// impersonates when creating pods, so RBAC and admission apply to them as if the
+	// ServiceAccount created them. It overrides the operator-wide default.
+	// +optional
+	CreatorServiceAccount string `json:"creatorServiceAccount,omitempty"`
+
+	// SLO is the availability objective the PodSet is tracked against
+	// +optional
+	SLO *SLO `json:"slo,omitempty"`
+
+	// QuarantineTTLSeconds is how long a pod annotated for quarantine is kept for
+	// inspection before it is deleted, unless the annotation extends it. Defaults to 86400.
+	// +optional
+	//+kubebuilder:validation:Minimum=1
+	QuarantineTTLSeconds *int32 `json:"quarantineTTLSeconds,omitempty"`
+
+	// Rebalance moves pods to under-populated zones or nodes when they are spread unevenly,
+	// e.g. after nodes were added
+	// +optional
+	Rebalance *Rebalance `json:"rebalance,omitempty"`
+
+	// ForceDeleteStuckPods force-deletes pods stuck terminating on a node that is not ready
+	// or unreachable, so that they stop holding up their replacements
+	// +optional
+	ForceDeleteStuckPods *ForceDeleteStuckPods `json:"forceDeleteStuckPods,omitempty"`
+
+	// LeaderElection makes the controller pick one ready pod as the leader of the PodSet
+	// +optional
+	LeaderElection *LeaderElection `json:"leaderElection,omitempty"`
+
+	// StartupBoost gives new pods extra CPU while they start
+	// +optional
+	StartupBoost *StartupBoost `json:"startupBoost,omitempty"`
+
+	// VolumeClaimTemplates are the claims every pod gets a PVC of its own from, named
+	// <template>-<pod>. The volume of the pod template with the template's name mounts it,
+	// one is added when there is none. The PVCs are deleted along with their pod, the data
+	// only lives as long as the pod and its replacement starts with new PVCs.
+	// +optional
+	VolumeClaimTemplates []VolumeClaimTemplate `json:"volumeClaimTemplates,omitempty"`
+
+	// VolumeSeed fills the PVCs of new pods from the PVCs of an existing replica
+	// +optional
+	VolumeSeed *VolumeSeed `json:"volumeSeed,omitempty"`
+}
+
+// VolumeClaimTemplate describes the PVC every pod of the PodSet gets, like the volume claim
+// templates of a StatefulSet
+type VolumeClaimTemplate struct {
+	Metadata VolumeClaimTemplateMetadata `json:"metadata"`
+
+	Spec corev1.PersistentVolumeClaimSpec `json:"spec"`
+}
+
+// VolumeClaimTemplateMetadata is the metadata the PVCs of a volume claim template get
+type VolumeClaimTemplateMetadata struct {
+	// Name identifies the template, the pod template's volume of the same name mounts the PVC
+	//+kubebuilder:validation:MaxLength=63
+	//+kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// VolumeSeed configures where the PVCs of new pods are cloned from
+type VolumeSeed struct {
+	// FromReadyReplica creates the PVCs of new pods as clones of the PVCs of a ready pod.
+	// Where the storage can't clone, the seeded PVC doesn't get bound; after 5 minutes its pod
+	// is replaced by one with empty volumes, which are used until the PodSet's spec changes.
+	// +optional
+	FromReadyReplica bool `json:"fromReadyReplica,omitempty"`
+}
+
+// StartupBoost adds CPU to the containers of new pods, which is taken away again with an
+// in-place resize once the pod is ready or the boost's duration is up. Only containers with a
+// CPU request are boosted, a resize can't change the QoS class of a pod.
+type StartupBoost struct {
+	// CPU is added to the CPU request, and limit if there is one, of every container
+	CPU resource.Quantity `json:"cpu"`
+
+	// DurationSeconds is how long after the pod started the boost lasts, it lasts until the pod
+	// is ready when empty
+	// +optional
+	//+kubebuilder:validation:Minimum=1
+	DurationSeconds *int32 `json:"durationSeconds,omitempty"`
+}
+
+// LeaderElection configures the election of a leader pod. The leader is labelled with the role
+// leader, the other pods with the role follower, and a Service named <podset>-leader targets the
+// leader. A new leader is picked when the current one gets unready or is deleted.
+type LeaderElection struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ForceDeleteStuckPods configures when pods stuck terminating are force-deleted
+type ForceDeleteStuckPods struct {
+	// TimeoutSeconds is how long past its deletion grace period a pod has to be terminating
+	// before it is force-deleted
+	// +optional
+	//+kubebuilder:default=300
+	//+kubebuilder:validation:Minimum=0
+	TimeoutSeconds int32 `json:"timeoutSeconds,omitempty"`
+}
+
+// CapacityCheck configures the capacity pre-check done before scaling up
+type CapacityCheck struct {
+	// Enabled turns the pre-check on
+	Enabled bool `json:"enabled"`
+
+	// CreatePartial creates the pods that fit when there isn't room for all of
+	// them, instead of creating none until there is
+	// +optional
+	CreatePartial bool `json:"createPartial,omitempty"`
+}
+
+// SLO is an availability objective: the share of the desired pods that should be ready
+// over a rolling window
+type SLO struct {
+	// Target is the availability objective in percent, e.g. 99.9, from 0 to 100
+	Target Percentage `json:"target"`
+
+	// Window is the rolling window availability is measured over, in days, hours or
+	// minutes, e.g. "30d". It has to be at least a minute long.
+	//+kubebuilder:validation:Pattern=`^[1-9][0-9]*(d|h|m)$`
+	Window string `json:"window"`
+
+	// BlockRollouts holds back the rollout of a new template revision while the error
+	// budget is exhausted
+	// +optional
+	BlockRollouts bool `json:"blockRollouts,omitempty"`
+}
+
+// RebalanceTopology names the domains pods are spread across by the rebalancer
+//+kubebuilder:validation:Enum=Zone;Node
+type RebalanceTopology string
+
+const (
+	// ZoneTopology spreads pods across the zones of their nodes
+	ZoneTopology RebalanceTopology = "Zone"
+
+	// NodeTopology spreads pods across nodes
+	NodeTopology RebalanceTopology = "Node"
+)
+
+// Rebalance configures the gradual moving of pods from over- to under-populated domains.
+// A pod is moved by creating its replacement in the target domain first and deleting it once
+// the replacement is ready.
+type Rebalance struct {
+	// Topology is the kind of domain pods are spread across
+	// +optional
+	//+kubebuilder:default=Zone
+	Topology RebalanceTopology `json:"topology,omitempty"`
+
+	// MaxSkew is the largest difference in pods between two domains that is left alone
+	// +optional
+	//+kubebuilder:default=1
+	//+kubebuilder:validation:Minimum=1
+	MaxSkew int32 `json:"maxSkew,omitempty"`
+
+	// MinIntervalSeconds is the least time between two moves. Defaults to 300.
+	// +optional
+	//+kubebuilder:validation:Minimum=0
+	MinIntervalSeconds *int32 `json:"minIntervalSeconds,omitempty"`
+
+	// MaintenanceWindows are the times pods may be moved in, any time when empty
+	// +optional
+	MaintenanceWindows []MaintenanceWindow `json:"maintenanceWindows,omitempty"`
+}
+
+// MaintenanceWindow is a recurring slot of time, in UTC
+type MaintenanceWindow struct {
+	// Days are the days of the week the window opens on, every day when empty
+	// +optional
+	Days []Weekday `json:"days,omitempty"`
+
+	// Start is the time of day the window opens, as HH:MM
+	//+kubebuilder:validation:Pattern=`^([01][0-9]|2[0-3]):[0-5][0-9]$`
+	Start string `json:"start"`
+
+	// Duration is how long the window stays open, in hours or minutes, e.g. "2h"
+	//+kubebuilder:validation:Pattern=`^[0-9]+(h|m)$`
+	Duration string `json:"duration"`
+}
+
+// Weekday is a day of the week
+//+kubebuilder:validation:Enum=Monday;Tuesday;Wednesday;Thursday;Friday;Saturday;Sunday
+type Weekday string
+
+// Percentage is a number of percent. It keeps the decimal as written, and is read from a
+// string too, as objects written before it was a number have one.
+//+kubebuilder:validation:Type=number
+type Percentage string
+
+// MarshalJSON writes the percentage as a number, or as a string if it isn't one
+func (p Percentage) MarshalJSON() ([]byte, error) {
+	if _, err := strconv.ParseFloat(string(p), 64); err != nil || !json.Valid([]byte(p)) {
+		return json.Marshal(string(p))
+	}
+	return []byte(p), nil
+}
+
+// UnmarshalJSON reads the percentage from a number or a string
+func (p *Percentage) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*p = Percentage(value)
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return err
+	}
+	*p = Percentage(number.String())
+	return nil
+}
+
+// Float64 is the percentage as a number
+func (p Percentage) Float64() (float64, error) {
+	return strconv.ParseFloat(string(p), 64)
+}
+
+// TemporaryScale is a replica count that only holds until it expires
+type TemporaryScale struct {
+	//+kubebuilder:validation:Minimum=0
+	Replicas int32 `json:"replicas"`
+
+	ExpiresAt metav1.Time `json:"expiresAt"`
+}
+
+// PlacementMode tells how many pods a PodSet runs and where
+//+kubebuilder:validation:Enum=Replicas;PerNode
+type PlacementMode string
+
+const (
+	// ReplicasPlacementMode runs spec.replicas pods wherever they are scheduled
+	ReplicasPlacementMode PlacementMode = "Replicas"
+
+	// PerNodePlacementMode runs one pod bound to every eligible node, like a DaemonSet
+	PerNodePlacementMode PlacementMode = "PerNode"
+)
+
+// VictimRanking names a strategy that orders pods for removal on scale-down
+//+kubebuilder:validation:Enum=Default;Consolidation
+type VictimRanking string
+
+const (
+	// DefaultVictimRanking removes pods still waiting for a node first
+	DefaultVictimRanking VictimRanking = "Default"
+
+	// ConsolidationVictimRanking removes pods from the least utilized nodes first,
+	// so that the cluster autoscaler can free those nodes
+	ConsolidationVictimRanking VictimRanking = "Consolidation"
+)
+
+// ScaleDownPolicy configures how a PodSet scales down
+type ScaleDownPolicy struct {
+	// VictimRanking is the strategy used to pick the pods to remove
+	// +optional
+	//+kubebuilder:default=Default
+	VictimRanking VictimRanking `json:"victimRanking,omitempty"`
+}
+
+// RolloutStrategy configures the rollout of a new template revision. The pods of the
+// new revision are created first and the outdated pods are removed as the new ones
+// get scheduled. While the rollout is held back, e.g. by a pre-pull, the outdated pods
+// still count towards the replicas and lost ones are replaced from the revision that
+// was rolled out last.
+type RolloutStrategy struct {
+	// PrePull pulls the images of the new revision onto the eligible nodes with a
+	// temporary DaemonSet before any pod is replaced
+	// +optional
+	PrePull bool `json:"prePull,omitempty"`
+
+	// PrePullTimeoutSeconds bounds how long the rollout waits for the images to be
+	// pulled, it carries on regardless afterwards. Defaults to 600.
+	// +optional
+	//+kubebuilder:validation:Minimum=1
+	PrePullTimeoutSeconds *int32 `json:"prePullTimeoutSeconds,omitempty"`
+}
+
+// RolloutHooks are Jobs run when a new template revision is rolled out
+type RolloutHooks struct {
+	// PreRollout runs before any pod of the new revision is created. The rollout
+	// waits for it to succeed and is aborted if it fails.
+	// +optional
+	//+kubebuilder:validation:Schemaless
+	//+kubebuilder:pruning:PreserveUnknownFields
+	//+kubebuilder:validation:Type=object
+	PreRollout *batchv1.JobTemplateSpec `json:"preRollout,omitempty"`
+
+	// PostRollout runs once all pods of the new revision are ready
+	// +optional
+	//+kubebuilder:validation:Schemaless
+	//+kubebuilder:pruning:PreserveUnknownFields
+	//+kubebuilder:validation:Type=object
+	PostRollout *batchv1.JobTemplateSpec `json:"postRollout,omitempty"`
+}
+
+// CapacityMix defines the variants a PodSet's pods are distributed across
+type CapacityMix struct {
+	// Variants are the placement variants, the replicas are split between
+	// them proportionally to their weights
+	//+kubebuilder:validation:MinItems=1
+	Variants []CapacityVariant `json:"variants"`
+
+	// UnschedulableTimeoutSeconds is how long a pod of a variant may stay
+	// unschedulable before the variant is considered out of capacity and its
+	// share falls back to the other variants. The variant is retried after the
+	// same amount of time. Defaults to 300.
+	// +optional
+	//+kubebuilder:validation:Minimum=1
+	UnschedulableTimeoutSeconds *int32 `json:"unschedulableTimeoutSeconds,omitempty"`
+}
+
+// CapacityVariant is one node-selector/toleration combination pods can be placed on
+type CapacityVariant struct {
+	// Name identifies the variant, it is stamped on the pods placed on it
+	Name string `json:"name"`
+
+	// Weight is the share of the replicas that should run on this variant,
+	// relative to the weights of the other variants
+	//+kubebuilder:validation:Minimum=0
+	Weight int32 `json:"weight"`
+
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+}
+
+// NodePool is one entry of the ordered node pool preferences of a PodSet
+type NodePool struct {
+	// Name identifies the pool, it is stamped on the pods placed on it
+	Name string `json:"name"`
+
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// UnschedulableTimeoutSeconds is how long pods may stay unschedulable on
+	// this pool before falling back to the next one. Pods are tried on the pool
+	// again after the same amount of time. Defaults to 300.
+	// +optional
+	//+kubebuilder:validation:Minimum=1
+	UnschedulableTimeoutSeconds *int32 `json:"unschedulableTimeoutSeconds,omitempty"`
 }
 
 // PodSetStatus defines the observed state of PodSet
@@ -37,6 +469,256 @@ type PodSetStatus struct {
 	// Important: Run "make" to regenerate code after modifying this file
 
 	PodNames []string `json:"podNames"`
+
+	// ReadyReplicas is the number of pods that report themselves as ready
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// CurrentRevision is the revision of the template the pods are rolled out to
+	// +optional
+	CurrentRevision string `json:"currentRevision,omitempty"`
+
+	// UpdatedReplicas is the number of pods running the current revision
+	// +optional
+	UpdatedReplicas int32 `json:"updatedReplicas,omitempty"`
+
+	// CurrentRevisionNumber is the sequence number of the current revision in the
+	// revision history
+	// +optional
+	CurrentRevisionNumber int64 `json:"currentRevisionNumber,omitempty"`
+
+	// PrePull reports the image pre-pull of the revision being rolled out
+	// +optional
+	PrePull *PrePullStatus `json:"prePull,omitempty"`
+
+	// RolloutHooks records the hook results of the most recent revisions
+	// +optional
+	RolloutHooks []RolloutHookStatus `json:"rolloutHooks,omitempty"`
+
+	// CapacityMix reports the per-variant distribution of the pods
+	// +optional
+	CapacityMix []CapacityVariantStatus `json:"capacityMix,omitempty"`
+
+	// NodePools reports the state of the node pools in order of preference
+	// +optional
+	NodePools []NodePoolStatus `json:"nodePools,omitempty"`
+
+	// PodVersions is the version label every pod carries
+	// +optional
+	PodVersions []PodVersion `json:"podVersions,omitempty"`
+
+	// PodPlacements tracks which node pool every pod was placed on
+	// +optional
+	PodPlacements []PodPlacement `json:"podPlacements,omitempty"`
+
+	// TemporaryScale is the temporary scale in effect
+	// +optional
+	TemporaryScale *TemporaryScale `json:"temporaryScale,omitempty"`
+
+	// Leader is the name of the pod elected leader
+	// +optional
+	Leader string `json:"leader,omitempty"`
+
+	// Zones breaks the pods down by the zone of the node they run on
+	// +optional
+	Zones []TopologyDomainStatus `json:"zones,omitempty"`
+
+	// Nodes breaks the pods down by the node they run on
+	// +optional
+	Nodes []TopologyDomainStatus `json:"nodes,omitempty"`
+
+	// SLO is the availability measured against the PodSet's objective
+	// +optional
+	SLO *SLOStatus `json:"slo,omitempty"`
+
+	// QuarantinedPods are the pods taken out of the PodSet for inspection
+	// +optional
+	QuarantinedPods []QuarantinedPod `json:"quarantinedPods,omitempty"`
+
+	// CapacityShortfall is the number of pods the capacity pre-check found no
+	// room for on the last scale-up
+	// +optional
+	CapacityShortfall int32 `json:"capacityShortfall,omitempty"`
+
+	// Conditions describe the state of the PodSet, e.g. InsufficientCapacity
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// PrePullStatus is the observed state of an image pre-pull
+type PrePullStatus struct {
+	// Revision is the template revision whose images are pulled
+	Revision string `json:"revision"`
+
+	StartTime metav1.Time `json:"startTime"`
+
+	// CompletionTime is set once the images are pulled or the timeout passed
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// TimedOut tells whether the rollout went ahead before all nodes pulled the images
+	// +optional
+	TimedOut bool `json:"timedOut,omitempty"`
+}
+
+// RolloutHookStatus records the hooks run for one revision
+type RolloutHookStatus struct {
+	Revision string `json:"revision"`
+
+	// +optional
+	PreRollout *HookResult `json:"preRollout,omitempty"`
+
+	// +optional
+	PostRollout *HookResult `json:"postRollout,omitempty"`
+}
+
+// HookPhase is the state of a hook Job
+type HookPhase string
+
+const (
+	HookRunning   HookPhase = "Running"
+	HookSucceeded HookPhase = "Succeeded"
+	HookFailed    HookPhase = "Failed"
+)
+
+// HookResult is the outcome of a hook Job
+type HookResult struct {
+	JobName string `json:"jobName"`
+
+	Phase HookPhase `json:"phase"`
+
+	StartTime metav1.Time `json:"startTime"`
+
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// ChangeCauseAnnotation on a PodSet is recorded with the revision of its template, to
+// explain in the revision history what changed
+const ChangeCauseAnnotation = "kubernetes.io/change-cause"
+
+// ConditionInsufficientCapacity is true while the capacity pre-check finds that the
+// pods needed to scale up don't fit on the schedulable nodes
+const ConditionInsufficientCapacity = "InsufficientCapacity"
+
+// ConditionErrorBudgetExhausted is true while the PodSet has used up the error budget of its SLO
+const ConditionErrorBudgetExhausted = "ErrorBudgetExhausted"
+
+// ConditionVolumeCloning tells whether the PVCs of new pods can be cloned from a ready
+// replica. It is false once a clone didn't get bound in time, new PVCs are then created empty
+// until the spec changes.
+const ConditionVolumeCloning = "VolumeCloning"
+
+// CapacityVariantStatus is the observed state of one capacity variant
+type CapacityVariantStatus struct {
+	Name string `json:"name"`
+
+	// Desired is the number of pods the variant should currently run,
+	// after falling back from unavailable variants
+	Desired int32 `json:"desired"`
+
+	// Current is the number of pods currently placed on the variant
+	Current int32 `json:"current"`
+
+	// UnavailableSince is set while the variant is considered out of capacity
+	// +optional
+	UnavailableSince *metav1.Time `json:"unavailableSince,omitempty"`
+}
+
+// NodePoolStatus is the observed state of one node pool
+type NodePoolStatus struct {
+	Name string `json:"name"`
+
+	// Desired is the number of pods the pool should currently run
+	Desired int32 `json:"desired"`
+
+	// Current is the number of pods currently placed on the pool
+	Current int32 `json:"current"`
+
+	// UnavailableSince is set while pods fall back from this pool
+	// +optional
+	UnavailableSince *metav1.Time `json:"unavailableSince,omitempty"`
+}
+
+// PodVersion is the application version of a single pod
+type PodVersion struct {
+	PodName string `json:"podName"`
+
+	Version string `json:"version"`
+}
+
+// TopologyDomainStatus counts the pods of a PodSet in one zone or on one node
+type TopologyDomainStatus struct {
+	Name string `json:"name"`
+
+	// Desired is the number of pods placed in the domain
+	Desired int32 `json:"desired"`
+
+	// Ready is the number of those pods that are ready
+	Ready int32 `json:"ready"`
+
+	// Updated is the number of those pods created from the current template revision
+	Updated int32 `json:"updated"`
+}
+
+// SLOStatus is the availability of a PodSet over its SLO window
+type SLOStatus struct {
+	// Availability is the measured availability in percent
+	// +optional
+	Availability string `json:"availability,omitempty"`
+
+	// ErrorBudgetRemaining is the percentage of the error budget left, negative once overspent
+	// +optional
+	ErrorBudgetRemaining string `json:"errorBudgetRemaining,omitempty"`
+
+	// Buckets are rollups of the samples, the window is split into 30 of them
+	// +optional
+	Buckets []SLOBucket `json:"buckets,omitempty"`
+
+	// LastSampleTime is when ready and desired pods were last sampled, the sample
+	// counts until the next one
+	// +optional
+	LastSampleTime *metav1.Time `json:"lastSampleTime,omitempty"`
+
+	// +optional
+	LastReadyReplicas int32 `json:"lastReadyReplicas,omitempty"`
+
+	// +optional
+	LastDesiredReplicas int32 `json:"lastDesiredReplicas,omitempty"`
+}
+
+// SLOBucket sums up availability over one slice of the SLO window
+type SLOBucket struct {
+	Start metav1.Time `json:"start"`
+
+	// DesiredReplicaSeconds is the number of desired pods integrated over time
+	DesiredReplicaSeconds int64 `json:"desiredReplicaSeconds"`
+
+	// ReadyReplicaSeconds is the number of ready pods, up to the desired ones, integrated over time
+	ReadyReplicaSeconds int64 `json:"readyReplicaSeconds"`
+}
+
+// QuarantinedPod is a pod kept for inspection after it was replaced
+type QuarantinedPod struct {
+	PodName string `json:"podName"`
+
+	// ExpiresAt is when the pod gets deleted
+	ExpiresAt metav1.Time `json:"expiresAt"`
+}
+
+// PodPlacement is the node pool placement of a single pod
+type PodPlacement struct {
+	PodName string `json:"podName"`
+
+	NodePool string `json:"nodePool"`
+
+	// NodeName is the node the pod got bound to, empty while it waits for capacity
+	// +optional
+	NodeName string `json:"nodeName,omitempty"`
+
+	// UnschedulableSince is set while the scheduler can't place the pod
+	// +optional
+	UnschedulableSince *metav1.Time `json:"unschedulableSince,omitempty"`
 }
 
 //+kubebuilder:object:root=true
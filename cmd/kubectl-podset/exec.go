@@ -0,0 +1,197 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// execResult is the outcome of running the command in one pod
+type execResult struct {
+	pod      string
+	output   bytes.Buffer
+	exitCode int
+	err      error
+}
+
+// runExec runs a command in every selected pod of the PodSet, at most parallelism pods at a
+// time, and prints the output of every pod once it is done followed by a summary
+func runExec(args []string) error {
+	var o options
+	var container string
+	var parallelism int
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: kubectl podset exec <name> [flags] -- <command> [args...]")
+		fs.PrintDefaults()
+	}
+	o.bind(fs)
+	fs.StringVar(&container, "c", "", "The container to run the command in, the first container by default.")
+	fs.IntVar(&parallelism, "parallelism", 5, "Number of pods the command runs in at the same time.")
+
+	// everything after "--" is the command
+	var command []string
+	for i, arg := range args {
+		if arg == "--" {
+			command = args[i+1:]
+			args = args[:i]
+			break
+		}
+	}
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || len(command) == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected a PodSet name and a command after --")
+	}
+	if parallelism < 1 {
+		return fmt.Errorf("--parallelism must be at least 1")
+	}
+	if err := o.complete(); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	pods, err := o.podSetPods(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+
+	results := runInPods(pods, parallelism, func(pod *corev1.Pod, out *bytes.Buffer) error {
+		return o.execInPod(ctx, pod, container, command, out)
+	})
+
+	failed := 0
+	for _, result := range results {
+		fmt.Printf("==> %s (exit code %d) <==\n", result.pod, result.exitCode)
+		fmt.Print(result.output.String())
+		if result.output.Len() > 0 && !strings.HasSuffix(result.output.String(), "\n") {
+			fmt.Println()
+		}
+		if result.err != nil {
+			failed++
+			var exitErr utilexec.ExitError
+			if !errors.As(result.err, &exitErr) {
+				fmt.Printf("error: %v\n", result.err)
+			}
+		}
+	}
+	fmt.Printf("\n%d of %d pods succeeded\n", len(results)-failed, len(results))
+	if failed > 0 {
+		return fmt.Errorf("command failed in %d pods", failed)
+	}
+	return nil
+}
+
+// runInPods runs a function for every pod, at most parallelism pods at a time, and returns
+// the results in the order of the pods
+func runInPods(pods []corev1.Pod, parallelism int, run func(pod *corev1.Pod, out *bytes.Buffer) error) []*execResult {
+	results := make([]*execResult, len(pods))
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i := range pods {
+		results[i] = &execResult{pod: pods[i].Name}
+		wg.Add(1)
+		go func(pod *corev1.Pod, result *execResult) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			result.err = run(pod, &result.output)
+			result.exitCode = exitCode(result.err)
+		}(&pods[i], results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// execInPod runs the command in the pod, writing stdout and stderr to out
+func (o *options) execInPod(ctx context.Context, pod *corev1.Pod, container string, command []string, out *bytes.Buffer) error {
+	if container == "" {
+		container = pod.Spec.Containers[0].Name
+	}
+	req := o.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, clientgoscheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(o.config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+
+	// stdout and stderr are written from separate goroutines
+	writer := &lockedWriter{w: out}
+	done := make(chan error, 1)
+	go func() {
+		done <- executor.Stream(remotecommand.StreamOptions{Stdout: writer, Stderr: writer})
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lockedWriter serializes writes to a buffer
+type lockedWriter struct {
+	mu sync.Mutex
+	w  *bytes.Buffer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// exitCode maps an error to the exit code of the plugin, passing on the exit code of a
+// command that failed remotely
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+	return 1
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+func TestRunInPods(t *testing.T) {
+	tests := []struct {
+		name        string
+		pods        int
+		parallelism int
+		wantMax     int
+	}{
+		{name: "one at a time", pods: 4, parallelism: 1, wantMax: 1},
+		{name: "limited", pods: 6, parallelism: 2, wantMax: 2},
+		{name: "fewer pods than the limit", pods: 3, parallelism: 5, wantMax: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pods []corev1.Pod
+			for i := 0; i < tt.pods; i++ {
+				pods = append(pods, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("web-%d", i)}})
+			}
+
+			var mu sync.Mutex
+			running, max := 0, 0
+			results := runInPods(pods, tt.parallelism, func(pod *corev1.Pod, out *bytes.Buffer) error {
+				mu.Lock()
+				running++
+				if running > max {
+					max = running
+				}
+				mu.Unlock()
+				// give the other pods the time to start if they are allowed to
+				time.Sleep(50 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+
+				fmt.Fprintf(out, "hello from %s", pod.Name)
+				switch pod.Name {
+				case "web-1":
+					return utilexec.CodeExitError{Err: errors.New("command terminated with exit code 3"), Code: 3}
+				case "web-2":
+					return errors.New("connection refused")
+				}
+				return nil
+			})
+
+			if max != tt.wantMax {
+				t.Errorf("%d pods ran at the same time, want %d", max, tt.wantMax)
+			}
+			if len(results) != tt.pods {
+				t.Fatalf("got %d results, want %d", len(results), tt.pods)
+			}
+			for i, result := range results {
+				if result.pod != pods[i].Name || result.output.String() != "hello from "+pods[i].Name {
+					t.Errorf("result %d is %s with output %q", i, result.pod, result.output.String())
+				}
+				wantCode := 0
+				switch result.pod {
+				case "web-1":
+					wantCode = 3
+				case "web-2":
+					wantCode = 1
+				}
+				if result.exitCode != wantCode {
+					t.Errorf("%s exited with %d, want %d", result.pod, result.exitCode, wantCode)
+				}
+			}
+		})
+	}
+}
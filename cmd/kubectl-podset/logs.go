@@ -0,0 +1,158 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// runLogs streams the logs of the PodSet's pods, every line prefixed with the pod and container
+// it came from. Lines of different pods are interleaved as they arrive.
+func runLogs(args []string) error {
+	var o options
+	var container string
+	var follow, timestamps bool
+	var tail, since int64
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: kubectl podset logs <name> [flags]")
+		fs.PrintDefaults()
+	}
+	o.bind(fs)
+	fs.StringVar(&container, "c", "", "Only print the logs of this container, all containers are printed by default.")
+	fs.BoolVar(&follow, "f", false, "Follow the logs.")
+	fs.BoolVar(&follow, "follow", false, "Follow the logs.")
+	fs.BoolVar(&timestamps, "timestamps", false, "Include timestamps on each line.")
+	fs.Int64Var(&tail, "tail", -1, "Number of recent lines to print per container, all lines by default.")
+	fs.Int64Var(&since, "since-seconds", 0, "Only print lines newer than this many seconds.")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one PodSet name")
+	}
+	if err := o.complete(); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	pods, err := o.podSetPods(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+
+	out := &lineWriter{w: os.Stdout}
+	var wg sync.WaitGroup
+	// every stream sends at most one error, so none of them blocks before wg.Wait returns
+	streams := 0
+	for i := range pods {
+		streams += len(podContainers(&pods[i], container))
+	}
+	errs := make(chan error, streams)
+	for _, pod := range pods {
+		for _, name := range podContainers(&pod, container) {
+			logOptions := &corev1.PodLogOptions{
+				Container:  name,
+				Follow:     follow,
+				Timestamps: timestamps,
+			}
+			if tail >= 0 {
+				logOptions.TailLines = &tail
+			}
+			if since > 0 {
+				logOptions.SinceSeconds = &since
+			}
+			prefix := fmt.Sprintf("[%s/%s] ", pod.Name, name)
+
+			wg.Add(1)
+			go func(podName string) {
+				defer wg.Done()
+				stream, err := o.clientset.CoreV1().Pods(o.namespace).GetLogs(podName, logOptions).Stream(ctx)
+				if err != nil {
+					errs <- fmt.Errorf("%s%v", prefix, err)
+					return
+				}
+				defer stream.Close()
+				if err := out.copyLines(prefix, stream); err != nil && ctx.Err() == nil {
+					errs <- fmt.Errorf("%s%v", prefix, err)
+				}
+			}(pod.Name)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	for err := range errs {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		failed++
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to get %d of the log streams", failed)
+	}
+	return nil
+}
+
+// podContainers lists the containers whose logs are printed
+func podContainers(pod *corev1.Pod, only string) []string {
+	if only != "" {
+		return []string{only}
+	}
+	var names []string
+	for _, container := range pod.Spec.InitContainers {
+		names = append(names, container.Name)
+	}
+	for _, container := range pod.Spec.Containers {
+		names = append(names, container.Name)
+	}
+	return names
+}
+
+// lineWriter writes whole lines from concurrent streams without mixing them up
+type lineWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// copyLines copies the stream line by line, prefixing every line
+func (l *lineWriter) copyLines(prefix string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		l.mu.Lock()
+		_, err := fmt.Fprintf(l.w, "%s%s\n", prefix, scanner.Bytes())
+		l.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
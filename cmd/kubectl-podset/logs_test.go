@@ -0,0 +1,126 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPodContainers(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "init"}},
+		Containers:     []corev1.Container{{Name: "app"}, {Name: "sidecar"}},
+	}}
+	tests := []struct {
+		name string
+		only string
+		want []string
+	}{
+		{name: "init containers first", want: []string{"init", "app", "sidecar"}},
+		{name: "one container", only: "sidecar", want: []string{"sidecar"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podContainers(pod, tt.only); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podContainers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams map[string]string
+		want    map[string][]string
+	}{
+		{
+			name:    "one stream",
+			streams: map[string]string{"[web-a/app] ": "first\nsecond\n"},
+			want:    map[string][]string{"[web-a/app] ": {"first", "second"}},
+		},
+		{
+			name:    "unterminated last line",
+			streams: map[string]string{"[web-a/app] ": "first\nsecond"},
+			want:    map[string][]string{"[web-a/app] ": {"first", "second"}},
+		},
+		{
+			name: "concurrent streams keep their lines whole and in order",
+			streams: map[string]string{
+				"[web-a/app] ":     strings.Repeat("a line of web-a\n", 500),
+				"[web-b/app] ":     strings.Repeat("a line of web-b\n", 500),
+				"[web-b/sidecar] ": strings.Repeat("a line of the sidecar\n", 500),
+			},
+			want: map[string][]string{
+				"[web-a/app] ":     strings.Split(strings.Repeat("a line of web-a\n", 500), "\n")[:500],
+				"[web-b/app] ":     strings.Split(strings.Repeat("a line of web-b\n", 500), "\n")[:500],
+				"[web-b/sidecar] ": strings.Split(strings.Repeat("a line of the sidecar\n", 500), "\n")[:500],
+			},
+		},
+		{
+			name:    "lines longer than the initial buffer",
+			streams: map[string]string{"[web-a/app] ": strings.Repeat("x", 100*1024) + "\nshort\n"},
+			want:    map[string][]string{"[web-a/app] ": {strings.Repeat("x", 100*1024), "short"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			writer := &lineWriter{w: &out}
+			var wg sync.WaitGroup
+			for prefix, content := range tt.streams {
+				wg.Add(1)
+				go func(prefix, content string) {
+					defer wg.Done()
+					if err := writer.copyLines(prefix, strings.NewReader(content)); err != nil {
+						t.Error(err)
+					}
+				}(prefix, content)
+			}
+			wg.Wait()
+
+			got := map[string][]string{}
+			for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+				end := strings.Index(line, "] ")
+				if end < 0 {
+					t.Fatalf("line without prefix: %q", line)
+				}
+				prefix := line[:end+2]
+				got[prefix] = append(got[prefix], line[end+2:])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("copyLines() wrote %s, want %s", summarize(got), summarize(tt.want))
+			}
+		})
+	}
+}
+
+// summarize keeps the failure message of long streams readable
+func summarize(streams map[string][]string) string {
+	var parts []string
+	for prefix, lines := range streams {
+		parts = append(parts, fmt.Sprintf("%q: %d lines", prefix, len(lines)))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-podset is a kubectl plugin for working with the pods of a PodSet,
+// install it on the PATH and run it as "kubectl podset".
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `Work with the pods of a PodSet.
+
+Usage:
+  kubectl podset logs <name> [flags]               print the logs of the PodSet's pods
+  kubectl podset exec <name> [flags] -- <command>  run a command in every pod of the PodSet
+  kubectl podset rollout history <name> [flags]    list the template revisions of the PodSet
+  kubectl podset rollout diff <name> --from N      show what changed between two revisions
+
+Run "kubectl podset <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "logs":
+		err = runLogs(os.Args[2:])
+	case "exec":
+		err = runExec(os.Args[2:])
+	case "rollout":
+		err = runRollout(os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		err = fmt.Errorf("unknown command %q", os.Args[1])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(appv1alpha1.AddToScheme(scheme))
+}
+
+// options are the flags shared by all commands
+type options struct {
+	kubeconfig string
+	context    string
+	namespace  string
+	// labelPrefix has to match the prefix the operator is configured with
+	labelPrefix string
+
+	// pod selection
+	ordinals intList
+	revision string
+
+	config    *rest.Config
+	client    client.Client
+	clientset kubernetes.Interface
+}
+
+// bind registers the shared flags on the command's flag set
+func (o *options) bind(fs *flag.FlagSet) {
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file to use.")
+	fs.StringVar(&o.context, "context", "", "The name of the kubeconfig context to use.")
+	fs.StringVar(&o.namespace, "namespace", "", "The namespace of the PodSet.")
+	fs.StringVar(&o.namespace, "n", "", "The namespace of the PodSet (shorthand).")
+	fs.StringVar(&o.labelPrefix, "label-prefix", "app.github.com", "The prefix of the label keys the operator manages.")
+	fs.Var(&o.ordinals, "ordinal", "Only use the pod with this ordinal, may be repeated. "+
+		"PodSet pods have no stable identity, ordinals number them from oldest to newest starting at 0.")
+	fs.StringVar(&o.revision, "revision", "", "Only use the pods of this template revision.")
+}
+
+// complete loads the kubeconfig and sets up the clients
+func (o *options) complete() error {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeconfig
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: o.context})
+
+	var err error
+	if o.config, err = loader.ClientConfig(); err != nil {
+		return err
+	}
+	if o.namespace == "" {
+		if o.namespace, _, err = loader.Namespace(); err != nil {
+			return err
+		}
+	}
+	if o.client, err = client.New(o.config, client.Options{Scheme: scheme}); err != nil {
+		return err
+	}
+	o.clientset, err = kubernetes.NewForConfig(o.config)
+	return err
+}
+
+// podSetPods returns the pods controlled by the PodSet that match the selection flags,
+// oldest first
+func (o *options) podSetPods(ctx context.Context, name string) ([]corev1.Pod, error) {
+	podSet := &appv1alpha1.PodSet{}
+	if err := o.client.Get(ctx, types.NamespacedName{Namespace: o.namespace, Name: name}, podSet); err != nil {
+		return nil, err
+	}
+
+	// pods are selected by the PodSet's UID, and only the ones it controls are kept, so that
+	// pods of other tools that happen to carry the same labels are left alone
+	podList := &corev1.PodList{}
+	if err := o.client.List(ctx, podList, client.InNamespace(o.namespace), client.MatchingLabels{o.label("podset-uid"): string(podSet.UID)}); err != nil {
+		return nil, err
+	}
+	var pods []corev1.Pod
+	for _, pod := range podList.Items {
+		if pod.DeletionTimestamp == nil && metav1.IsControlledBy(&pod, podSet) {
+			pods = append(pods, pod)
+		}
+	}
+	sort.SliceStable(pods, func(i, j int) bool {
+		if !pods[i].CreationTimestamp.Equal(&pods[j].CreationTimestamp) {
+			return pods[i].CreationTimestamp.Before(&pods[j].CreationTimestamp)
+		}
+		return pods[i].Name < pods[j].Name
+	})
+
+	var selected []corev1.Pod
+	for ordinal, pod := range pods {
+		if len(o.ordinals) > 0 && !o.ordinals.contains(ordinal) {
+			continue
+		}
+		if o.revision != "" && pod.Labels[o.label("revision")] != o.revision {
+			continue
+		}
+		selected = append(selected, pod)
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no pods of PodSet %s/%s match", o.namespace, name)
+	}
+	return selected, nil
+}
+
+// label is the key of a label the operator manages, e.g. "revision" for the template
+// revision of a pod or "podset" for the revision history of a PodSet
+func (o *options) label(name string) string {
+	return o.labelPrefix + "/" + name
+}
+
+// intList is a repeatable integer flag
+type intList []int
+
+func (l *intList) String() string {
+	return fmt.Sprint([]int(*l))
+}
+
+func (l *intList) Set(value string) error {
+	var i int
+	if _, err := fmt.Sscanf(value, "%d", &i); err != nil {
+		return fmt.Errorf("%q is not an ordinal", value)
+	}
+	*l = append(*l, i)
+	return nil
+}
+
+func (l intList) contains(i int) bool {
+	for _, v := range l {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+// parseArgs parses flags that may come before or after the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+func TestPodSetPods(t *testing.T) {
+	podSet := &appv1alpha1.PodSet{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"}}
+	other := &appv1alpha1.PodSet{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default", UID: "other-uid"}}
+	created := time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC)
+	// pod makes a pod labelled with the UID of the PodSet, controlled by the owner if there is one
+	pod := func(name string, age int, revision string, owner *appv1alpha1.PodSet) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(created.Add(-time.Duration(age) * time.Minute)),
+			Labels:            map[string]string{"app.github.com/podset-uid": "web-uid", "app.github.com/revision": revision},
+		}}
+		if owner != nil {
+			controller := true
+			pod.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: appv1alpha1.GroupVersion.String(), Kind: "PodSet", Name: owner.Name, UID: owner.UID, Controller: &controller,
+			}}
+		}
+		return pod
+	}
+	pods := []client.Object{
+		pod("web-b", 3, "r1", podSet),
+		pod("web-a", 3, "r1", podSet),
+		pod("web-c", 2, "r2", podSet),
+		pod("web-d", 1, "r2", podSet),
+		// the UID label alone isn't enough
+		pod("orphan", 5, "r1", nil),
+		pod("foreign", 4, "r1", other),
+	}
+	unlabelled := pod("unlabelled", 6, "r1", podSet)
+	delete(unlabelled.Labels, "app.github.com/podset-uid")
+	pods = append(pods, unlabelled)
+
+	tests := []struct {
+		name     string
+		ordinals intList
+		revision string
+		want     []string
+		wantErr  bool
+	}{
+		{name: "controlled pods oldest first", want: []string{"web-a", "web-b", "web-c", "web-d"}},
+		{name: "ordinals", ordinals: intList{0, 3}, want: []string{"web-a", "web-d"}},
+		{name: "revision", revision: "r2", want: []string{"web-c", "web-d"}},
+		{name: "ordinals count before the revision filter", ordinals: intList{1, 2}, revision: "r2", want: []string{"web-c"}},
+		{name: "ordinal out of range", ordinals: intList{4}, wantErr: true},
+		{name: "unknown revision", revision: "r3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &options{
+				namespace:   "default",
+				labelPrefix: "app.github.com",
+				ordinals:    tt.ordinals,
+				revision:    tt.revision,
+				client:      fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(pods, podSet.DeepCopy(), other.DeepCopy())...).Build(),
+			}
+			selected, err := o.podSetPods(context.Background(), "web")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("podSetPods() = %d pods, want an error", len(selected))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, pod := range selected {
+				got = append(got, pod.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podSetPods() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
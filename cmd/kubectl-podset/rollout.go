@@ -0,0 +1,245 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+// runRollout dispatches the rollout subcommands
+func runRollout(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected a rollout command: history or diff")
+	}
+	switch args[0] {
+	case "history":
+		return runRolloutHistory(args[1:])
+	case "diff":
+		return runRolloutDiff(args[1:])
+	default:
+		return fmt.Errorf("unknown rollout command %q", args[0])
+	}
+}
+
+// runRolloutHistory lists the recorded revisions of a PodSet
+func runRolloutHistory(args []string) error {
+	var o options
+	fs := flag.NewFlagSet("rollout history", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: kubectl podset rollout history <name> [flags]")
+		fs.PrintDefaults()
+	}
+	o.bind(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one PodSet name")
+	}
+	if err := o.complete(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	podSet, revisions, err := o.revisionHistory(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "REVISION\tHASH\tAGE\tCHANGE-CAUSE")
+	for _, revision := range revisions {
+		number := fmt.Sprint(revision.Revision)
+		if revision.Labels[o.label("revision")] == podSet.Status.CurrentRevision {
+			number += " (current)"
+		}
+		changeCause := revision.Annotations[appv1alpha1.ChangeCauseAnnotation]
+		if changeCause == "" {
+			changeCause = "<none>"
+		}
+		age := duration.HumanDuration(time.Since(revision.CreationTimestamp.Time))
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", number, revision.Labels[o.label("revision")], age, changeCause)
+	}
+	return w.Flush()
+}
+
+// runRolloutDiff prints what changed in the template between two revisions
+func runRolloutDiff(args []string) error {
+	var o options
+	var from, to int64
+	fs := flag.NewFlagSet("rollout diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: kubectl podset rollout diff <name> --from N [--to M] [flags]")
+		fs.PrintDefaults()
+	}
+	o.bind(fs)
+	fs.Int64Var(&from, "from", 0, "The revision to compare from.")
+	fs.Int64Var(&to, "to", 0, "The revision to compare to, the latest revision by default.")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || from == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one PodSet name and --from")
+	}
+	if err := o.complete(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	_, revisions, err := o.revisionHistory(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+	if to == 0 && len(revisions) > 0 {
+		to = revisions[len(revisions)-1].Revision
+	}
+	fromRevision, err := findRevision(revisions, from)
+	if err != nil {
+		return err
+	}
+	toRevision, err := findRevision(revisions, to)
+	if err != nil {
+		return err
+	}
+
+	var fromTemplate, toTemplate interface{}
+	if err := json.Unmarshal(fromRevision.Data.Raw, &fromTemplate); err != nil {
+		return fmt.Errorf("failed to decode revision %d: %v", from, err)
+	}
+	if err := json.Unmarshal(toRevision.Data.Raw, &toTemplate); err != nil {
+		return fmt.Errorf("failed to decode revision %d: %v", to, err)
+	}
+
+	fmt.Printf("--- revision %d (%s)\n+++ revision %d (%s)\n", from, fromRevision.Labels[o.label("revision")], to, toRevision.Labels[o.label("revision")])
+	changes := diffTemplates(fromTemplate, toTemplate)
+	if len(changes) == 0 {
+		fmt.Println("no changes")
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	return nil
+}
+
+// revisionHistory returns the PodSet and its recorded revisions, oldest first
+func (o *options) revisionHistory(ctx context.Context, name string) (*appv1alpha1.PodSet, []appsv1.ControllerRevision, error) {
+	podSet := &appv1alpha1.PodSet{}
+	if err := o.client.Get(ctx, types.NamespacedName{Namespace: o.namespace, Name: name}, podSet); err != nil {
+		return nil, nil, err
+	}
+	history := &appsv1.ControllerRevisionList{}
+	if err := o.client.List(ctx, history, client.InNamespace(o.namespace), client.MatchingLabels{o.label("podset"): name}); err != nil {
+		return nil, nil, err
+	}
+	var revisions []appsv1.ControllerRevision
+	for _, revision := range history.Items {
+		if metav1.IsControlledBy(&revision, podSet) {
+			revisions = append(revisions, revision)
+		}
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision < revisions[j].Revision
+	})
+	return podSet, revisions, nil
+}
+
+// findRevision picks a revision by its sequence number
+func findRevision(revisions []appsv1.ControllerRevision, number int64) (*appsv1.ControllerRevision, error) {
+	for i := range revisions {
+		if revisions[i].Revision == number {
+			return &revisions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("revision %d not found in the history", number)
+}
+
+// diffTemplates compares two decoded templates field by field and describes every
+// removed (-), added (+) and changed (~) field by its path
+func diffTemplates(from, to interface{}) []string {
+	fromFields, toFields := map[string]string{}, map[string]string{}
+	flatten("", from, fromFields)
+	flatten("", to, toFields)
+
+	paths := map[string]bool{}
+	for path := range fromFields {
+		paths[path] = true
+	}
+	for path := range toFields {
+		paths[path] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	var changes []string
+	for _, path := range sorted {
+		oldValue, inFrom := fromFields[path]
+		newValue, inTo := toFields[path]
+		switch {
+		case !inTo:
+			changes = append(changes, fmt.Sprintf("- %s: %s", path, oldValue))
+		case !inFrom:
+			changes = append(changes, fmt.Sprintf("+ %s: %s", path, newValue))
+		case oldValue != newValue:
+			changes = append(changes, fmt.Sprintf("~ %s: %s -> %s", path, oldValue, newValue))
+		}
+	}
+	return changes
+}
+
+// flatten turns a decoded JSON value into one entry per leaf, keyed by the leaf's path
+func flatten(path string, value interface{}, fields map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			flatten(childPath, child, fields)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flatten(fmt.Sprintf("%s[%d]", path, i), child, fields)
+		}
+	default:
+		data, _ := json.Marshal(v)
+		fields[path] = strings.TrimSpace(string(data))
+	}
+}
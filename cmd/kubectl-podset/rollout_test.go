@@ -0,0 +1,87 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffTemplates(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     []string
+	}{
+		{
+			name: "identical",
+			from: `{"spec":{"containers":[{"name":"app","image":"nginx:1.21"}]}}`,
+			to:   `{"spec":{"containers":[{"name":"app","image":"nginx:1.21"}]}}`,
+		},
+		{
+			name: "changed field",
+			from: `{"spec":{"containers":[{"name":"app","image":"nginx:1.21"}]}}`,
+			to:   `{"spec":{"containers":[{"name":"app","image":"nginx:1.22"}]}}`,
+			want: []string{`~ spec.containers[0].image: "nginx:1.21" -> "nginx:1.22"`},
+		},
+		{
+			name: "added and removed fields",
+			from: `{"metadata":{"labels":{"tier":"web"}},"spec":{"restartPolicy":"Always"}}`,
+			to:   `{"metadata":{"labels":{"team":"a"}},"spec":{"restartPolicy":"Always"}}`,
+			want: []string{`+ metadata.labels.team: "a"`, `- metadata.labels.tier: "web"`},
+		},
+		{
+			name: "added list entry",
+			from: `{"spec":{"containers":[{"name":"app"}]}}`,
+			to:   `{"spec":{"containers":[{"name":"app"},{"name":"sidecar"}]}}`,
+			want: []string{`+ spec.containers[1].name: "sidecar"`},
+		},
+		{
+			name: "changed type",
+			from: `{"spec":{"terminationGracePeriodSeconds":30}}`,
+			to:   `{"spec":{"terminationGracePeriodSeconds":"30"}}`,
+			want: []string{`~ spec.terminationGracePeriodSeconds: 30 -> "30"`},
+		},
+		{
+			name: "null and empty values",
+			from: `{"spec":{"nodeSelector":null}}`,
+			to:   `{"spec":{"nodeSelector":{}}}`,
+			want: []string{`- spec.nodeSelector: null`},
+		},
+		{
+			name: "sorted by path",
+			from: `{"b":1,"a":{"c":1}}`,
+			to:   `{"b":2,"a":{"c":2}}`,
+			want: []string{`~ a.c: 1 -> 2`, `~ b: 1 -> 2`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var from, to interface{}
+			if err := json.Unmarshal([]byte(tt.from), &from); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.to), &to); err != nil {
+				t.Fatal(err)
+			}
+			if got := diffTemplates(from, to); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffTemplates() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+// capacityRecheckInterval is how often a PodSet waiting for capacity is checked again,
+// nodes are not watched so freed capacity isn't noticed otherwise
+const capacityRecheckInterval = 30 * time.Second
+
+// nodeCapacity is what is left of a schedulable node while placing pods on it
+type nodeCapacity struct {
+	node *corev1.Node
+	free corev1.ResourceList
+	pods int64
+}
+
+// schedulableCapacity lists the room left on every node that accepts new pods
+func (r *PodSetReconciler) schedulableCapacity(ctx context.Context) ([]*nodeCapacity, error) {
+	nodeList := &corev1.NodeList{}
+	if err := r.Client.List(ctx, nodeList); err != nil {
+		return nil, err
+	}
+
+	var capacity []*nodeCapacity
+	for i := range nodeList.Items {
+		node := &nodeList.Items[i]
+		if node.Spec.Unschedulable || !isNodeReady(node) {
+			continue
+		}
+		requested, pods, err := nodeRequested(ctx, r.Client, node.Name)
+		if err != nil {
+			return nil, err
+		}
+		free := node.Status.Allocatable.DeepCopy()
+		subtractResources(free, requested)
+		capacity = append(capacity, &nodeCapacity{node: node, free: free, pods: node.Status.Allocatable.Pods().Value() - pods})
+	}
+	return capacity, nil
+}
+
+// isNodeReady tells whether the node reports itself as ready
+func isNodeReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// accepts tells whether the pod's node selector, required node affinity and tolerations allow
+// it onto the node
+func (n *nodeCapacity) accepts(pod *corev1.Pod) bool {
+	if !labels.SelectorFromSet(pod.Spec.NodeSelector).Matches(labels.Set(n.node.Labels)) {
+		return false
+	}
+	if affinity := pod.Spec.Affinity; affinity != nil && affinity.NodeAffinity != nil &&
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil &&
+		!matchesNodeSelectorTerms(n.node, affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms) {
+		return false
+	}
+	for i := range n.node.Spec.Taints {
+		taint := &n.node.Spec.Taints[i]
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		tolerated := false
+		for j := range pod.Spec.Tolerations {
+			if pod.Spec.Tolerations[j].ToleratesTaint(taint) {
+				tolerated = true
+				break
+			}
+		}
+		if !tolerated {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesNodeSelectorTerms tells whether the node matches any of the terms, the way the
+// scheduler evaluates required node affinity: the requirements of a term are ANDed, and a term
+// without any requirement matches no node
+func matchesNodeSelectorTerms(node *corev1.Node, terms []corev1.NodeSelectorTerm) bool {
+	for _, term := range terms {
+		if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+			continue
+		}
+		if matchesNodeSelectorRequirements(labels.Set(node.Labels), term.MatchExpressions) &&
+			matchesNodeFields(node, term.MatchFields) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesNodeFields tells whether the node meets all field requirements, metadata.name with
+// In or NotIn being the only ones the API allows. Node names can be longer than label values,
+// so they are compared directly.
+func matchesNodeFields(node *corev1.Node, requirements []corev1.NodeSelectorRequirement) bool {
+	for _, requirement := range requirements {
+		if requirement.Key != "metadata.name" {
+			return false
+		}
+		listed := false
+		for _, value := range requirement.Values {
+			listed = listed || value == node.Name
+		}
+		switch requirement.Operator {
+		case corev1.NodeSelectorOpIn:
+			if !listed {
+				return false
+			}
+		case corev1.NodeSelectorOpNotIn:
+			if listed {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// matchesNodeSelectorRequirements tells whether the labels, or fields, meet all requirements
+func matchesNodeSelectorRequirements(set labels.Set, requirements []corev1.NodeSelectorRequirement) bool {
+	operators := map[corev1.NodeSelectorOperator]selection.Operator{
+		corev1.NodeSelectorOpIn:           selection.In,
+		corev1.NodeSelectorOpNotIn:        selection.NotIn,
+		corev1.NodeSelectorOpExists:       selection.Exists,
+		corev1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+		corev1.NodeSelectorOpGt:           selection.GreaterThan,
+		corev1.NodeSelectorOpLt:           selection.LessThan,
+	}
+	for _, requirement := range requirements {
+		operator, ok := operators[requirement.Operator]
+		if !ok {
+			return false
+		}
+		r, err := labels.NewRequirement(requirement.Key, operator, requirement.Values)
+		if err != nil || !r.Matches(set) {
+			return false
+		}
+	}
+	return true
+}
+
+// place takes the room for up to count copies of a pod requesting the given resources
+// from the node and returns how many fit
+func (n *nodeCapacity) place(requests corev1.ResourceList, count int32) int32 {
+	var placed int32
+	for placed < count && n.pods > 0 {
+		for name, quantity := range requests {
+			free, ok := n.free[name]
+			if !ok || free.Cmp(quantity) < 0 {
+				return placed
+			}
+		}
+		subtractResources(n.free, requests)
+		n.pods--
+		placed++
+	}
+	return placed
+}
+
+// checkCapacity estimates how many of the missing pods of every group fit on the schedulable
+// nodes, records the result in status and returns the number of pods to create per group.
+// Unless the PodSet allows partial scale-ups nothing is created while anything is short.
+func (r *PodSetReconciler) checkCapacity(ctx context.Context, cr *appv1alpha1.PodSet, groups []placementGroup, missingPods []int32, status *appv1alpha1.PodSetStatus) ([]int32, error) {
+	check := cr.Spec.CapacityCheck
+	if check == nil || !check.Enabled || !features.Enabled(features.CapacityCheck) {
+		status.CapacityShortfall = 0
+		meta.RemoveStatusCondition(&status.Conditions, appv1alpha1.ConditionInsufficientCapacity)
+		return missingPods, nil
+	}
+
+	var requested int32
+	for _, missing := range missingPods {
+		requested += missing
+	}
+	if requested == 0 {
+		status.CapacityShortfall = 0
+		if meta.IsStatusConditionTrue(status.Conditions, appv1alpha1.ConditionInsufficientCapacity) {
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               appv1alpha1.ConditionInsufficientCapacity,
+				Status:             metav1.ConditionFalse,
+				ObservedGeneration: cr.Generation,
+				Reason:             "NoPendingScaleUp",
+				Message:            "no pods are waiting to be created",
+			})
+		}
+		return missingPods, nil
+	}
+
+	capacity, err := r.schedulableCapacity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fitting := make([]int32, len(missingPods))
+	var shortfall int32
+	for i, missing := range missingPods {
+		if missing == 0 {
+			continue
+		}
+		pod := r.newPodForPodSetCustomResource(cr)
+		groups[i].applyTo(pod)
+		requests := podRequests(pod)
+		for _, node := range capacity {
+			if fitting[i] == missing {
+				break
+			}
+			if node.accepts(pod) {
+				fitting[i] += node.place(requests, missing-fitting[i])
+			}
+		}
+		shortfall += missing - fitting[i]
+	}
+
+	status.CapacityShortfall = shortfall
+	if shortfall == 0 {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               appv1alpha1.ConditionInsufficientCapacity,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: cr.Generation,
+			Reason:             "CapacityAvailable",
+			Message:            fmt.Sprintf("all %d new pods fit on the schedulable nodes", requested),
+		})
+		return missingPods, nil
+	}
+
+	log.Log.Info("Insufficient capacity to scale up PodSet", "requested", requested, "shortfall", shortfall)
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               appv1alpha1.ConditionInsufficientCapacity,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: cr.Generation,
+		Reason:             "NodesFull",
+		Message:            fmt.Sprintf("%d of %d new pods don't fit on the schedulable nodes", shortfall, requested),
+	})
+	if check.CreatePartial {
+		return fitting, nil
+	}
+	return make([]int32, len(missingPods)), nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+// capacityMixGroups turns the variants of the capacity mix into placement groups.
+//
+// A variant whose pods have stayed unschedulable for longer than the timeout is marked
+// unavailable and its share is distributed over the remaining variants. Once the timeout
+// has passed again the variant is retried; when its pods get scheduled the surplus on the
+// fallback variants is removed, which re-balances the mix.
+func capacityMixGroups(cr *appv1alpha1.PodSet, pods []corev1.Pod, status *appv1alpha1.PodSetStatus, now time.Time) ([]placementGroup, time.Duration) {
+	mix := cr.Spec.CapacityMix
+	timeout := unschedulableTimeout(mix.UnschedulableTimeoutSeconds)
+
+	previous := map[string]*metav1.Time{}
+	for _, variant := range cr.Status.CapacityMix {
+		previous[variant.Name] = variant.UnavailableSince
+	}
+	podsByGroup := podsPerPlacementGroup(pods)
+
+	var requeueAfter time.Duration
+	unavailableSince := make([]*metav1.Time, len(mix.Variants))
+	availableWeights := make([]int32, len(mix.Variants))
+	anyAvailable := false
+	for i, variant := range mix.Variants {
+		since, wait := groupUnavailableSince(previous[variant.Name], podsByGroup[variant.Name], timeout, now)
+		requeueAfter = minRequeue(requeueAfter, wait)
+		if since == nil {
+			availableWeights[i] = variant.Weight
+			anyAvailable = anyAvailable || variant.Weight > 0
+		}
+		unavailableSince[i] = since
+	}
+
+	// with every variant out of capacity there is nothing to fall back to, keep the configured ratios
+	if !anyAvailable {
+		for i, variant := range mix.Variants {
+			availableWeights[i] = variant.Weight
+		}
+	}
+	desired := distributeReplicas(cr.Spec.Replicas, availableWeights)
+
+	groups := make([]placementGroup, len(mix.Variants))
+	status.CapacityMix = make([]appv1alpha1.CapacityVariantStatus, len(mix.Variants))
+	for i, variant := range mix.Variants {
+		groups[i] = placementGroup{
+			name:         variant.Name,
+			nodeSelector: variant.NodeSelector,
+			tolerations:  variant.Tolerations,
+			desired:      desired[i],
+		}
+		status.CapacityMix[i] = appv1alpha1.CapacityVariantStatus{
+			Name:             variant.Name,
+			Desired:          desired[i],
+			Current:          int32(len(podsByGroup[variant.Name])),
+			UnavailableSince: unavailableSince[i],
+		}
+	}
+	return groups, requeueAfter
+}
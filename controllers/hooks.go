@@ -0,0 +1,211 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+const (
+	preRolloutHook  = "pre-rollout"
+	postRolloutHook = "post-rollout"
+
+	// maxRolloutHookHistory is the number of revisions whose hook results are kept in status
+	maxRolloutHookHistory = 10
+)
+
+// rolloutHookStatus finds the hook results of the revision, adding an entry if asked to
+func rolloutHookStatus(status *appv1alpha1.PodSetStatus, revision string, create bool) *appv1alpha1.RolloutHookStatus {
+	for i := range status.RolloutHooks {
+		if status.RolloutHooks[i].Revision == revision {
+			return &status.RolloutHooks[i]
+		}
+	}
+	if !create {
+		return nil
+	}
+	status.RolloutHooks = append(status.RolloutHooks, appv1alpha1.RolloutHookStatus{Revision: revision})
+	if len(status.RolloutHooks) > maxRolloutHookHistory {
+		status.RolloutHooks = status.RolloutHooks[len(status.RolloutHooks)-maxRolloutHookHistory:]
+	}
+	return &status.RolloutHooks[len(status.RolloutHooks)-1]
+}
+
+// preRolloutHook runs the pre-rollout hook of a revision that is about to be rolled out and
+// returns whether the rollout may go ahead. A failed hook aborts the rollout of the revision,
+// the outdated pods are kept, and lost ones replaced, until the template changes again.
+func (r *PodSetReconciler) preRolloutHook(ctx context.Context, cr *appv1alpha1.PodSet, revision string, status *appv1alpha1.PodSetStatus) (bool, error) {
+	if cr.Spec.Hooks == nil || !features.Enabled(features.RolloutHooks) {
+		return true, nil
+	}
+	// the entry also tells the post-rollout hook that the revision was rolled out
+	entry := rolloutHookStatus(status, revision, true)
+	if cr.Spec.Hooks.PreRollout == nil {
+		return true, nil
+	}
+	if entry.PreRollout == nil {
+		result, err := r.startHook(ctx, cr, revision, preRolloutHook, cr.Spec.Hooks.PreRollout)
+		if err != nil {
+			return false, err
+		}
+		entry.PreRollout = result
+		return false, nil
+	}
+	if err := r.observeHook(ctx, cr, entry.PreRollout); err != nil {
+		return false, err
+	}
+	if entry.PreRollout.Phase == appv1alpha1.HookFailed {
+		log.Log.Info("Pre-rollout hook failed, aborting rollout of PodSet", "revision", revision, "job", entry.PreRollout.JobName)
+	}
+	return entry.PreRollout.Phase == appv1alpha1.HookSucceeded, nil
+}
+
+// postRolloutHook runs the post-rollout hook once every pod of a rolled out revision is ready
+func (r *PodSetReconciler) postRolloutHook(ctx context.Context, cr *appv1alpha1.PodSet, revision string, updatedPods []corev1.Pod, status *appv1alpha1.PodSetStatus) error {
+	if cr.Spec.Hooks == nil || cr.Spec.Hooks.PostRollout == nil || !features.Enabled(features.RolloutHooks) {
+		return nil
+	}
+	// revisions that were never rolled out over older pods, e.g. a new PodSet, have no entry
+	entry := rolloutHookStatus(status, revision, false)
+	if entry == nil {
+		return nil
+	}
+	if entry.PostRollout != nil {
+		return r.observeHook(ctx, cr, entry.PostRollout)
+	}
+	if countReadyPods(updatedPods) < cr.Spec.Replicas {
+		return nil
+	}
+	result, err := r.startHook(ctx, cr, revision, postRolloutHook, cr.Spec.Hooks.PostRollout)
+	if err != nil {
+		return err
+	}
+	entry.PostRollout = result
+	return nil
+}
+
+// hookJobName names the Job of a hook. The name ends up in the job-name label of its pods, so
+// long PodSet names are cut short and a hash of the full name keeps it unique.
+func hookJobName(podSet, revision, hook string) string {
+	name := fmt.Sprintf("%s-%s-%s", podSet, revision, hook)
+	if len(name) <= validation.DNS1123LabelMaxLength {
+		return name
+	}
+	hasher := fnv.New32a()
+	hasher.Write([]byte(name))
+	suffix := fmt.Sprintf("-%s-%s-%s", revision, hook, rand.SafeEncodeString(fmt.Sprint(hasher.Sum32())))
+	return strings.TrimRight(podSet[:validation.DNS1123LabelMaxLength-len(suffix)], "-.") + suffix
+}
+
+// startHook creates the Job of a hook. An existing Job of the same name is taken over if the
+// PodSet owns it, e.g. when the status update recording the hook was lost.
+func (r *PodSetReconciler) startHook(ctx context.Context, cr *appv1alpha1.PodSet, revision, hook string, template *batchv1.JobTemplateSpec) (*appv1alpha1.HookResult, error) {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        hookJobName(cr.Name, revision, hook),
+			Namespace:   cr.Namespace,
+			Labels:      map[string]string{},
+			Annotations: template.Annotations,
+		},
+		Spec: *template.Spec.DeepCopy(),
+	}
+	for key, value := range template.Labels {
+		job.Labels[key] = value
+	}
+	job.Labels[hookLabel] = hook
+	job.Labels[revisionLabel] = revision
+	if err := controllerutil.SetControllerReference(cr, job, r.Scheme); err != nil {
+		return nil, err
+	}
+
+	// the Job runs an arbitrary pod spec, so it is created with the same identity as the pods
+	creator, err := r.podCreator(cr)
+	if err != nil {
+		return nil, err
+	}
+	log.Log.Info("Running rollout hook of PodSet", "hook", hook, "revision", revision, "job", job.Name)
+	err = creator.Create(ctx, job)
+	if errors.IsAlreadyExists(err) {
+		existing := &batchv1.Job{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Namespace: job.Namespace, Name: job.Name}, existing); err != nil {
+			return nil, err
+		}
+		if !metav1.IsControlledBy(existing, cr) {
+			r.Recorder.Eventf(cr, corev1.EventTypeWarning, "HookJobConflict", "Job %s of the %s hook exists and isn't owned by the PodSet", job.Name, hook)
+			return nil, fmt.Errorf("job %s/%s isn't owned by PodSet %s", job.Namespace, job.Name, cr.Name)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return &appv1alpha1.HookResult{
+		JobName:   job.Name,
+		Phase:     appv1alpha1.HookRunning,
+		StartTime: metav1.Now().Rfc3339Copy(),
+	}, nil
+}
+
+// observeHook updates the result of a running hook from its Job
+func (r *PodSetReconciler) observeHook(ctx context.Context, cr *appv1alpha1.PodSet, result *appv1alpha1.HookResult) error {
+	if result.Phase != appv1alpha1.HookRunning {
+		return nil
+	}
+	// a missing Job fails the hook, so it isn't taken from the cache that may lag behind its creation
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+	job := &batchv1.Job{}
+	err := reader.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: result.JobName}, job)
+	if errors.IsNotFound(err) {
+		// the Job was removed before it reported back, there is no telling whether it did its work
+		result.Phase = appv1alpha1.HookFailed
+	} else if err != nil {
+		return err
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			result.Phase = appv1alpha1.HookSucceeded
+		case batchv1.JobFailed:
+			result.Phase = appv1alpha1.HookFailed
+		}
+	}
+	if result.Phase != appv1alpha1.HookRunning {
+		completed := metav1.Now().Rfc3339Copy()
+		result.CompletionTime = &completed
+	}
+	return nil
+}
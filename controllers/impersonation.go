@@ -0,0 +1,81 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=impersonate
+
+// impersonatingClient is a client acting as a creator ServiceAccount
+type impersonatingClient struct {
+	username string
+	client   client.Client
+}
+
+// podCreator returns the client the PodSet's workload, its pods, hook Jobs, pre-pull DaemonSets
+// and Services, is created with. Unless a creator ServiceAccount is set on the PodSet or
+// operator-wide, that is the operator's own client.
+func (r *PodSetReconciler) podCreator(cr *appv1alpha1.PodSet) (client.Client, error) {
+	name := cr.Spec.CreatorServiceAccount
+	if name == "" {
+		name = r.CreatorServiceAccount
+	}
+	if name == "" || !features.Enabled(features.CreatorImpersonation) {
+		return r.Client, nil
+	}
+	if r.RestConfig == nil {
+		return nil, fmt.Errorf("no REST config to impersonate ServiceAccount %s/%s with", cr.Namespace, name)
+	}
+
+	username := fmt.Sprintf("system:serviceaccount:%s:%s", cr.Namespace, name)
+	key := client.ObjectKeyFromObject(cr)
+	r.creatorsMu.Lock()
+	defer r.creatorsMu.Unlock()
+	if c, ok := r.creators[key]; ok && c.username == username {
+		return c.client, nil
+	}
+
+	// no groups are impersonated, the API server adds the ones it puts ServiceAccounts in
+	// itself, so the operator never needs to impersonate arbitrary groups
+	config := rest.CopyConfig(r.RestConfig)
+	config.Impersonate = rest.ImpersonationConfig{UserName: username}
+	c, err := client.New(config, client.Options{Scheme: r.Scheme, Mapper: r.Client.RESTMapper()})
+	if err != nil {
+		return nil, err
+	}
+	if r.creators == nil {
+		r.creators = map[types.NamespacedName]impersonatingClient{}
+	}
+	r.creators[key] = impersonatingClient{username: username, client: c}
+	return c, nil
+}
+
+// forgetPodCreator drops the client of a deleted PodSet
+func (r *PodSetReconciler) forgetPodCreator(key types.NamespacedName) {
+	r.creatorsMu.Lock()
+	defer r.creatorsMu.Unlock()
+	delete(r.creators, key)
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+// DefaultLabelPrefix is the prefix of the label keys the controller manages
+const DefaultLabelPrefix = "app.github.com"
+
+// the keys of the labels and annotations the controller manages, all sharing a prefix set with SetLabelPrefix
+var (
+	// podSetLabel marks the objects the controller keeps on behalf of a PodSet, e.g. its pods
+	// and revision history
+	podSetLabel string
+	// podSetUIDLabel is what pods are selected by, unlike the name it can't be reused by a
+	// PodSet created later
+	podSetUIDLabel string
+	// revisionLabel records the template revision a pod was created from
+	revisionLabel string
+	// versionLabel carries the application version from spec.version
+	versionLabel string
+	// placementLabel records which placement group a pod was created for
+	placementLabel string
+	// prePullLabel marks the pre-pull DaemonSets of a PodSet
+	prePullLabel string
+	// hookLabel tells which hook a Job was run for
+	hookLabel string
+	// quarantinedLabel replaces all other labels of a quarantined pod, it holds the PodSet's UID
+	// so that only the controller selects on it
+	quarantinedLabel string
+	// roleLabel tells the leader pod of a PodSet with leader election apart from its followers
+	roleLabel string
+
+	// quarantineAnnotation is set by users on a pod to quarantine it, an RFC 3339 time as
+	// its value keeps the pod until then instead of for the PodSet's quarantine TTL
+	quarantineAnnotation string
+	// quarantinedAtAnnotation records when the pod was quarantined
+	quarantinedAtAnnotation string
+	// quarantinedLabelsAnnotation keeps the labels the pod had before it was quarantined
+	quarantinedLabelsAnnotation string
+	// placementNodeAnnotation records the node a pod of a PerNode PodSet was created for
+	placementNodeAnnotation string
+	// startupBoostAnnotation keeps the resources the containers of a boosted pod go back to
+	startupBoostAnnotation string
+	// rebalanceToAnnotation marks a pod the rebalancer is moving, it holds the target domain
+	// as <topology>/<name>
+	rebalanceToAnnotation string
+	// rebalanceReplacesAnnotation names the pod a rebalancing replacement was created for
+	rebalanceReplacesAnnotation string
+	// seededFromAnnotation records on a PVC the pod whose PVC it was cloned from
+	seededFromAnnotation string
+	// rebalanceLastMoveAnnotation records on the PodSet when the rebalancer last marked one of
+	// its pods, as an RFC 3339 time
+	rebalanceLastMoveAnnotation string
+	// rebalancePendingAnnotation records on the PodSet the move being carried out, as
+	// <marked pod>/<replacement pod>, before the replacement is created
+	rebalancePendingAnnotation string
+)
+
+// the unprefixed labels pods were created with before the keys were prefixed
+const (
+	legacyAppLabel     = "app"
+	legacyVersionLabel = "version"
+	// legacyVersion is the version every pod was labelled with before spec.version existed
+	legacyVersion = "v0.1"
+)
+
+func init() {
+	setLabelKeys(DefaultLabelPrefix)
+}
+
+// SetLabelPrefix changes the prefix of the label keys the controller manages.
+// It has to be called before the controllers are started.
+func SetLabelPrefix(prefix string) error {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if errs := validation.IsDNS1123Subdomain(prefix); len(errs) > 0 {
+		return fmt.Errorf("invalid label prefix %q: %s", prefix, strings.Join(errs, ", "))
+	}
+	setLabelKeys(prefix)
+	return nil
+}
+
+func setLabelKeys(prefix string) {
+	podSetLabel = prefix + "/podset"
+	podSetUIDLabel = prefix + "/podset-uid"
+	revisionLabel = prefix + "/revision"
+	versionLabel = prefix + "/version"
+	placementLabel = prefix + "/placement"
+	prePullLabel = prefix + "/prepull"
+	hookLabel = prefix + "/hook"
+	quarantinedLabel = prefix + "/quarantined"
+	roleLabel = prefix + "/role"
+	quarantineAnnotation = prefix + "/quarantine"
+	quarantinedAtAnnotation = prefix + "/quarantined-at"
+	quarantinedLabelsAnnotation = prefix + "/quarantined-labels"
+	placementNodeAnnotation = prefix + "/node"
+	startupBoostAnnotation = prefix + "/startup-boost"
+	rebalanceToAnnotation = prefix + "/rebalance-to"
+	rebalanceReplacesAnnotation = prefix + "/rebalance-replaces"
+	seededFromAnnotation = prefix + "/seeded-from"
+	rebalanceLastMoveAnnotation = prefix + "/rebalance-last-move"
+	rebalancePendingAnnotation = prefix + "/rebalance-pending"
+}
+
+// listPods lists the pods of the PodSet by its UID label, plus, while legacy selection is
+// on, the pods still only carrying the unprefixed labels they were created with
+func (r *PodSetReconciler) listPods(ctx context.Context, cr *appv1alpha1.PodSet) ([]corev1.Pod, error) {
+	podList := &corev1.PodList{}
+	if err := r.Client.List(ctx, podList, client.InNamespace(cr.Namespace), client.MatchingLabels{podSetUIDLabel: string(cr.UID)}); err != nil {
+		return nil, err
+	}
+	if !r.LegacyLabelSelection {
+		return podList.Items, nil
+	}
+
+	legacyList := &corev1.PodList{}
+	if err := r.Client.List(ctx, legacyList, client.InNamespace(cr.Namespace), client.MatchingLabels{legacyAppLabel: cr.Name}); err != nil {
+		return nil, err
+	}
+	pods := podList.Items
+	for _, pod := range legacyList.Items {
+		if _, ok := pod.Labels[podSetUIDLabel]; !ok {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// syncPodLabels keeps the managed labels of the PodSet's pods up to date, e.g. the version
+// when spec.version changes. Legacy-labelled pods get the prefixed labels added, their old
+// labels stay in place for whatever else selects them. Pods carrying the PodSet's UID that
+// lost their owner are adopted, and so are legacy pods while legacy selection is on. Pods
+// orphaned with --cascade=orphan carry the UID of the deleted PodSet, so a recreated PodSet
+// doesn't adopt them, the StrayPodSweeper reports them and deletes them after the orphan
+// grace period if one is set. Pods controlled by something else are left out, the
+// StrayPodSweeper reports them too.
+func (r *PodSetReconciler) syncPodLabels(ctx context.Context, cr *appv1alpha1.PodSet, pods []corev1.Pod) ([]corev1.Pod, error) {
+	wanted := map[string]string{
+		podSetLabel:    cr.Name,
+		podSetUIDLabel: string(cr.UID),
+		versionLabel:   podVersion(cr),
+	}
+	var owned []corev1.Pod
+	for i := range pods {
+		pod := &pods[i]
+		controller := metav1.GetControllerOf(pod)
+		if controller != nil && controller.UID != cr.UID {
+			continue
+		}
+		// pods without an owner are adopted when they carry the PodSet's UID, or the old fixed
+		// labels while legacy selection is on
+		legacy := r.LegacyLabelSelection && pod.Labels[legacyVersionLabel] == legacyVersion
+		if controller == nil && pod.Labels[podSetUIDLabel] != string(cr.UID) && !legacy {
+			continue
+		}
+		if controller == nil && pod.DeletionTimestamp != nil {
+			continue
+		}
+		if controller != nil && hasLabels(pod, wanted) {
+			owned = append(owned, *pod)
+			continue
+		}
+
+		patch := client.MergeFrom(pod.DeepCopy())
+		if controller == nil {
+			log.Log.Info("adopting pod", "PodSet", cr.Name, "pod", pod.Name)
+			if err := controllerutil.SetControllerReference(cr, pod, r.Scheme); err != nil {
+				return nil, err
+			}
+		}
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+		}
+		for key, value := range wanted {
+			pod.Labels[key] = value
+		}
+		if err := r.Client.Patch(ctx, pod, patch); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		owned = append(owned, *pod)
+	}
+	return owned, nil
+}
+
+// hasLabels tells whether the pod carries all of the labels
+func hasLabels(pod *corev1.Pod, labels map[string]string) bool {
+	for key, value := range labels {
+		if pod.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+// the values of roleLabel
+const (
+	roleLeader   = "leader"
+	roleFollower = "follower"
+)
+
+// electLeader keeps one ready pod of the PodSet labelled as its leader and the others as followers.
+// The leader keeps its role while it is ready, otherwise the oldest ready pod takes over. The
+// Service targeting the leader is kept up to date. The name of the leader is returned, empty when
+// no pod is ready. When leader election is off, the roles and the Service are removed.
+func (r *PodSetReconciler) electLeader(ctx context.Context, cr *appv1alpha1.PodSet, pods []corev1.Pod) (string, error) {
+	enabled := cr.Spec.LeaderElection != nil && cr.Spec.LeaderElection.Enabled && features.Enabled(features.LeaderElection)
+	if !enabled {
+		for i := range pods {
+			if err := r.setRole(ctx, &pods[i], ""); err != nil {
+				return "", err
+			}
+		}
+		return "", r.deleteLeaderService(ctx, cr)
+	}
+
+	var candidates []*corev1.Pod
+	leader := ""
+	for i := range pods {
+		pod := &pods[i]
+		if !isPodReady(pod) {
+			continue
+		}
+		candidates = append(candidates, pod)
+		if pod.Labels[roleLabel] == roleLeader && leader == "" {
+			leader = pod.Name
+		}
+	}
+	if leader == "" && len(candidates) > 0 {
+		sort.Slice(candidates, func(i, j int) bool {
+			if !candidates[i].CreationTimestamp.Equal(&candidates[j].CreationTimestamp) {
+				return candidates[i].CreationTimestamp.Before(&candidates[j].CreationTimestamp)
+			}
+			return candidates[i].Name < candidates[j].Name
+		})
+		leader = candidates[0].Name
+		log.Log.Info("Electing leader of PodSet", "PodSet", cr.Name, "pod", leader, "previous", cr.Status.Leader)
+		r.Recorder.Eventf(cr, corev1.EventTypeNormal, "LeaderElected", "Pod %s is the new leader", leader)
+	}
+
+	// the followers are demoted before the leader is promoted, so the Service never targets two pods
+	for i := range pods {
+		if pods[i].Name != leader {
+			if err := r.setRole(ctx, &pods[i], roleFollower); err != nil {
+				return "", err
+			}
+		}
+	}
+	for i := range pods {
+		if pods[i].Name == leader {
+			if err := r.setRole(ctx, &pods[i], roleLeader); err != nil {
+				return "", err
+			}
+		}
+	}
+	// a Service that can't be synced, e.g. because of the template's ports, doesn't stop the
+	// PodSet from scaling
+	if err := r.syncLeaderService(ctx, cr); err != nil {
+		log.Log.Error(err, "Failed to sync the leader Service of PodSet", "PodSet", cr.Name)
+		r.Recorder.Eventf(cr, corev1.EventTypeWarning, "FailedLeaderService", "Error syncing Service %s: %v", leaderServiceName(cr), err)
+	}
+	return leader, nil
+}
+
+// setRole labels the pod with the role, an empty role removes the label
+func (r *PodSetReconciler) setRole(ctx context.Context, pod *corev1.Pod, role string) error {
+	if current, ok := pod.Labels[roleLabel]; current == role && (ok || role == "") {
+		return nil
+	}
+	patch := client.MergeFrom(pod.DeepCopy())
+	if role == "" {
+		delete(pod.Labels, roleLabel)
+	} else {
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+		}
+		pod.Labels[roleLabel] = role
+	}
+	if err := r.Client.Patch(ctx, pod, patch); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// leaderServiceName is the name of the Service targeting the leader of the PodSet
+func leaderServiceName(cr *appv1alpha1.PodSet) string {
+	return cr.Name + "-leader"
+}
+
+// leaderServicePorts are the ports of the template's containers, each port and protocol once.
+// A Service with more than one port needs unique names, so missing or repeated names are
+// replaced by <protocol>-<port>.
+func leaderServicePorts(template *corev1.PodTemplateSpec) []corev1.ServicePort {
+	type key struct {
+		port     int32
+		protocol corev1.Protocol
+	}
+	seen := map[key]bool{}
+	var ports []corev1.ServicePort
+	for _, container := range template.Spec.Containers {
+		for _, port := range container.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			if seen[key{port.ContainerPort, protocol}] {
+				continue
+			}
+			seen[key{port.ContainerPort, protocol}] = true
+			ports = append(ports, corev1.ServicePort{
+				Name:       port.Name,
+				Protocol:   protocol,
+				Port:       port.ContainerPort,
+				TargetPort: intstr.FromInt(int(port.ContainerPort)),
+			})
+		}
+	}
+	if len(ports) < 2 {
+		return ports
+	}
+	names := map[string]bool{}
+	for i := range ports {
+		if ports[i].Name == "" || names[ports[i].Name] {
+			ports[i].Name = fmt.Sprintf("%s-%d", strings.ToLower(string(ports[i].Protocol)), ports[i].Port)
+		}
+		names[ports[i].Name] = true
+	}
+	return ports
+}
+
+// syncLeaderService creates or updates the Service targeting the leader. It exposes the ports
+// of the template's containers, and is headless if there are none. As a Service can't switch
+// between headless and not, it is recreated when that changes.
+func (r *PodSetReconciler) syncLeaderService(ctx context.Context, cr *appv1alpha1.PodSet) error {
+	selector := map[string]string{podSetUIDLabel: string(cr.UID), roleLabel: roleLeader}
+	ports := leaderServicePorts(podTemplate(cr))
+
+	creator, err := r.podCreator(cr)
+	if err != nil {
+		return err
+	}
+	service := &corev1.Service{}
+	err = r.Client.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: leaderServiceName(cr)}, service)
+	switch {
+	case errors.IsNotFound(err):
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      leaderServiceName(cr),
+				Namespace: cr.Namespace,
+				Labels:    map[string]string{podSetLabel: cr.Name},
+			},
+			Spec: corev1.ServiceSpec{
+				Selector: selector,
+				Ports:    ports,
+			},
+		}
+		if len(ports) == 0 {
+			service.Spec.ClusterIP = corev1.ClusterIPNone
+		}
+		if err = controllerutil.SetControllerReference(cr, service, r.Scheme); err != nil {
+			return err
+		}
+		log.Log.Info("Creating the leader Service of PodSet", "PodSet", cr.Name, "service", service.Name)
+		return creator.Create(ctx, service)
+	case err != nil:
+		return err
+	}
+
+	if !metav1.IsControlledBy(service, cr) {
+		log.Log.Info("Leaving a Service not controlled by the PodSet alone", "PodSet", cr.Name, "service", service.Name)
+		return nil
+	}
+	if headless := service.Spec.ClusterIP == corev1.ClusterIPNone; headless != (len(ports) == 0) {
+		// the Service is created again once its deletion is seen
+		log.Log.Info("Recreating the leader Service of PodSet", "PodSet", cr.Name, "service", service.Name, "headless", !headless)
+		return client.IgnoreNotFound(r.Client.Delete(ctx, service))
+	}
+	if reflect.DeepEqual(service.Spec.Selector, selector) && portsEqual(service.Spec.Ports, ports) {
+		return nil
+	}
+	service.Spec.Selector = selector
+	service.Spec.Ports = ports
+	return creator.Update(ctx, service)
+}
+
+// portsEqual compares the ports the controller sets, ignoring the ones the API server fills in
+func portsEqual(current, desired []corev1.ServicePort) bool {
+	if len(current) != len(desired) {
+		return false
+	}
+	for i := range current {
+		if current[i].Name != desired[i].Name || current[i].Port != desired[i].Port ||
+			current[i].Protocol != desired[i].Protocol || current[i].TargetPort != desired[i].TargetPort {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteLeaderService removes the Service of a PodSet that no longer elects a leader
+func (r *PodSetReconciler) deleteLeaderService(ctx context.Context, cr *appv1alpha1.PodSet) error {
+	service := &corev1.Service{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: leaderServiceName(cr)}, service)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !metav1.IsControlledBy(service, cr) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Client.Delete(ctx, service))
+}
@@ -0,0 +1,459 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+const (
+	// memberPodSetsFinalizer keeps a MultiClusterPodSet around until its member PodSets are deleted
+	memberPodSetsFinalizer = "app.github.com/member-podsets"
+	// multiClusterPodSetAnnotation marks the member PodSets with the MultiClusterPodSet owning them,
+	// owner references can't cross clusters
+	multiClusterPodSetAnnotation = "app.github.com/multiclusterpodset"
+	defaultKubeconfigKey         = "kubeconfig"
+	// member clusters aren't watched, their PodSets are polled
+	memberResyncInterval = 30 * time.Second
+	memberClientTimeout  = 10 * time.Second
+	// memberShortGracePeriod is how long a member may run fewer ready pods than assigned before
+	// it counts as degraded, so that it doesn't flap while its pods are rolled out
+	memberShortGracePeriod = time.Minute
+)
+
+// MultiClusterPodSetReconciler reconciles a MultiClusterPodSet object
+type MultiClusterPodSetReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// APIReader reads the kubeconfig Secrets, only their metadata is cached so that the
+	// manager doesn't keep every Secret of the cluster in memory. The Client is used when
+	// left empty.
+	APIReader client.Reader
+
+	// NewClusterClient connects to a member cluster using its kubeconfig,
+	// a plain client is built from the kubeconfig when left empty
+	NewClusterClient func(kubeconfig []byte) (client.Client, error)
+
+	mu      sync.Mutex
+	clients map[string]memberClient
+}
+
+// memberClient is a member cluster client, remembered until its kubeconfig Secret changes
+type memberClient struct {
+	resourceVersion string
+	client          client.Client
+}
+
+// memberState is what is known about one member cluster during a reconcile
+type memberState struct {
+	client client.Client
+	podSet *appv1alpha1.PodSet
+	status appv1alpha1.MemberClusterStatus
+	// short tells whether the PodSet runs fewer ready pods than it is assigned
+	short bool
+}
+
+//+kubebuilder:rbac:groups=app.github.com,resources=multiclusterpodsets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=app.github.com,resources=multiclusterpodsets/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=app.github.com,resources=multiclusterpodsets/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+
+// Reconcile spreads the replicas of a MultiClusterPodSet over PodSets in its member clusters
+// and moves them away from clusters that stay unreachable or degraded for too long
+func (r *MultiClusterPodSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	instance := &appv1alpha1.MultiClusterPodSet{}
+	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if instance.DeletionTimestamp != nil {
+		if !controllerutil.ContainsFinalizer(instance, memberPodSetsFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		if err := r.deleteMemberPodSets(ctx, instance, time.Now()); err != nil {
+			return ctrl.Result{}, err
+		}
+		controllerutil.RemoveFinalizer(instance, memberPodSetsFinalizer)
+		return ctrl.Result{}, r.Update(ctx, instance)
+	}
+	if !controllerutil.ContainsFinalizer(instance, memberPodSetsFinalizer) {
+		controllerutil.AddFinalizer(instance, memberPodSetsFinalizer)
+		if err := r.Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	now := time.Now()
+	timeout := unschedulableTimeout(instance.Spec.UnhealthyTimeoutSeconds)
+	previous := map[string]appv1alpha1.MemberClusterStatus{}
+	for _, cluster := range instance.Status.Clusters {
+		previous[cluster.Name] = cluster
+	}
+
+	requeueAfter := memberResyncInterval
+	members := make([]memberState, len(instance.Spec.Clusters))
+	for i, cluster := range instance.Spec.Clusters {
+		member := &members[i]
+		member.status.Name = cluster.Name
+		member.observe(ctx, r, instance, cluster)
+
+		last := previous[cluster.Name]
+		if member.short {
+			member.status.ShortSince = last.ShortSince
+			if member.status.ShortSince == nil {
+				since := metav1.NewTime(now).Rfc3339Copy()
+				member.status.ShortSince = &since
+			}
+			if wait := memberShortGracePeriod - now.Sub(member.status.ShortSince.Time); wait > 0 {
+				requeueAfter = minRequeue(requeueAfter, wait)
+			} else {
+				member.status.Message = fmt.Sprintf("%d of %d replicas are ready", member.podSet.Status.ReadyReplicas, member.podSet.Spec.Replicas)
+			}
+		}
+		if member.status.Message != "" {
+			member.status.DegradedSince = last.DegradedSince
+			if member.status.DegradedSince == nil {
+				since := metav1.NewTime(now).Rfc3339Copy()
+				member.status.DegradedSince = &since
+			}
+		}
+		var wait time.Duration
+		member.status.UnhealthySince, wait = clusterUnhealthySince(last.UnhealthySince, member.status.DegradedSince, timeout, now)
+		member.status.Healthy = member.status.UnhealthySince == nil
+		requeueAfter = minRequeue(requeueAfter, wait)
+	}
+
+	assigned := memberReplicas(instance.Spec.Replicas, instance.Spec.Clusters, members)
+	for i, cluster := range instance.Spec.Clusters {
+		member := &members[i]
+		member.status.AssignedReplicas = assigned[i]
+		if member.client == nil {
+			continue
+		}
+		if err := r.applyMemberPodSet(ctx, instance, cluster, member, assigned[i]); err != nil {
+			log.Log.Error(err, "unable to sync member PodSet", "MultiClusterPodSet", instance.Name, "cluster", cluster.Name)
+			member.status.Message = err.Error()
+		}
+	}
+
+	status := appv1alpha1.MultiClusterPodSetStatus{}
+	for _, member := range members {
+		status.Replicas += member.status.Replicas
+		status.ReadyReplicas += member.status.ReadyReplicas
+		status.Clusters = append(status.Clusters, member.status)
+	}
+	if !reflect.DeepEqual(instance.Status, status) {
+		instance.Status = status
+		if err := r.Status().Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// observe connects to the member cluster and reads its PodSet, a non-empty message
+// means the cluster is degraded. A PodSet short of ready pods only degrades the cluster
+// once it has been short for the grace period.
+func (m *memberState) observe(ctx context.Context, r *MultiClusterPodSetReconciler, cr *appv1alpha1.MultiClusterPodSet, cluster appv1alpha1.MemberCluster) {
+	c, err := r.memberClient(ctx, cr.Namespace, cluster.KubeconfigSecret)
+	if err != nil {
+		m.status.Message = err.Error()
+		return
+	}
+	podSet := &appv1alpha1.PodSet{}
+	err = c.Get(ctx, memberPodSetKey(cr, cluster), podSet)
+	if err != nil && !errors.IsNotFound(err) {
+		m.status.Message = err.Error()
+		return
+	}
+	m.client = c
+	if err != nil {
+		return
+	}
+
+	m.podSet = podSet
+	m.status.Replicas = int32(len(podSet.Status.PodNames))
+	m.status.ReadyReplicas = podSet.Status.ReadyReplicas
+	m.short = podSet.Status.ReadyReplicas < podSet.Spec.Replicas
+}
+
+// clusterUnhealthySince marks a member cluster unhealthy once it has been degraded for longer
+// than the timeout and gives it another chance once the timeout has passed again since,
+// just like groupUnavailableSince does for placement groups
+func clusterUnhealthySince(previous, degradedSince *metav1.Time, timeout time.Duration, now time.Time) (*metav1.Time, time.Duration) {
+	if previous != nil {
+		if wait := timeout - now.Sub(previous.Time); wait > 0 {
+			return previous, wait
+		}
+	}
+	if degradedSince == nil {
+		return nil, 0
+	}
+	if wait := timeout - now.Sub(degradedSince.Time); wait > 0 {
+		return nil, wait
+	}
+	marked := metav1.NewTime(now).Rfc3339Copy()
+	return &marked, timeout
+}
+
+// memberReplicas splits the replicas over the member clusters by weight. An unhealthy cluster
+// keeps the pods it still runs ready, an unreachable one is assumed to run none, and the rest
+// goes to the healthy clusters.
+func memberReplicas(replicas int32, clusters []appv1alpha1.MemberCluster, members []memberState) []int32 {
+	assigned := make([]int32, len(clusters))
+	var healthy []int
+	var weights []int32
+	remaining := replicas
+	for i := range members {
+		if members[i].status.Healthy {
+			healthy = append(healthy, i)
+			weights = append(weights, clusters[i].Weight)
+			continue
+		}
+		if members[i].podSet == nil {
+			continue
+		}
+		keep := members[i].podSet.Status.ReadyReplicas
+		if keep > members[i].podSet.Spec.Replicas {
+			keep = members[i].podSet.Spec.Replicas
+		}
+		if keep > remaining {
+			keep = remaining
+		}
+		assigned[i] = keep
+		remaining -= keep
+	}
+
+	// with no healthy cluster left there is nowhere to move the replicas to, stick to the weights
+	if len(healthy) == 0 {
+		weights = make([]int32, len(clusters))
+		for i, cluster := range clusters {
+			weights[i] = cluster.Weight
+		}
+		return distributeReplicas(replicas, weights)
+	}
+	for i, share := range distributeReplicas(remaining, weights) {
+		assigned[healthy[i]] = share
+	}
+	return assigned
+}
+
+// applyMemberPodSet creates or updates the PodSet in a member cluster
+func (r *MultiClusterPodSetReconciler) applyMemberPodSet(ctx context.Context, cr *appv1alpha1.MultiClusterPodSet, cluster appv1alpha1.MemberCluster, member *memberState, replicas int32) error {
+	spec := *cr.Spec.Template.DeepCopy()
+	spec.Replicas = replicas
+	owner := cr.Namespace + "/" + cr.Name
+
+	if member.podSet == nil {
+		key := memberPodSetKey(cr, cluster)
+		podSet := &appv1alpha1.PodSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        key.Name,
+				Namespace:   key.Namespace,
+				Annotations: map[string]string{multiClusterPodSetAnnotation: owner},
+			},
+			Spec: spec,
+		}
+		log.Log.Info("creating member PodSet", "MultiClusterPodSet", cr.Name, "cluster", cluster.Name, "replicas", replicas)
+		return member.client.Create(ctx, podSet)
+	}
+
+	// a PodSet of the same name that someone else created is left alone
+	if member.podSet.Annotations[multiClusterPodSetAnnotation] != owner {
+		return fmt.Errorf("PodSet %s/%s in cluster %s is not managed by this MultiClusterPodSet", member.podSet.Namespace, member.podSet.Name, cluster.Name)
+	}
+	if reflect.DeepEqual(member.podSet.Spec, spec) {
+		return nil
+	}
+	log.Log.Info("updating member PodSet", "MultiClusterPodSet", cr.Name, "cluster", cluster.Name, "replicas", replicas)
+	member.podSet.Spec = spec
+	return member.client.Update(ctx, member.podSet)
+}
+
+// deleteMemberPodSets removes the member PodSets before the MultiClusterPodSet goes away.
+// Clusters whose kubeconfig Secret is gone are skipped, there is no way to reach them anymore.
+// Clusters that still can't be reached once the deletion has been going on for the unhealthy
+// timeout are given up on, so that they don't hold the finalizer forever.
+func (r *MultiClusterPodSetReconciler) deleteMemberPodSets(ctx context.Context, cr *appv1alpha1.MultiClusterPodSet, now time.Time) error {
+	timeout := unschedulableTimeout(cr.Spec.UnhealthyTimeoutSeconds)
+	for _, cluster := range cr.Spec.Clusters {
+		err := r.deleteMemberPodSet(ctx, cr, cluster)
+		if err == nil {
+			continue
+		}
+		if now.Sub(cr.DeletionTimestamp.Time) < timeout {
+			return err
+		}
+		log.Log.Error(err, "giving up on deleting member PodSet", "MultiClusterPodSet", cr.Name, "cluster", cluster.Name)
+		r.Recorder.Eventf(cr, corev1.EventTypeWarning, "MemberPodSetLeftBehind",
+			"Gave up deleting the PodSet in cluster %s after %s: %v", cluster.Name, timeout, err)
+	}
+	return nil
+}
+
+// deleteMemberPodSet removes the PodSet of the MultiClusterPodSet from one member cluster
+func (r *MultiClusterPodSetReconciler) deleteMemberPodSet(ctx context.Context, cr *appv1alpha1.MultiClusterPodSet, cluster appv1alpha1.MemberCluster) error {
+	c, err := r.memberClient(ctx, cr.Namespace, cluster.KubeconfigSecret)
+	if errors.IsNotFound(err) {
+		log.Log.Info("kubeconfig Secret is gone, leaving member PodSet behind", "MultiClusterPodSet", cr.Name, "cluster", cluster.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	podSet := &appv1alpha1.PodSet{}
+	if err := c.Get(ctx, memberPodSetKey(cr, cluster), podSet); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if podSet.Annotations[multiClusterPodSetAnnotation] != cr.Namespace+"/"+cr.Name {
+		return nil
+	}
+	log.Log.Info("deleting member PodSet", "MultiClusterPodSet", cr.Name, "cluster", cluster.Name)
+	return client.IgnoreNotFound(c.Delete(ctx, podSet))
+}
+
+// memberPodSetKey is where the PodSet of a MultiClusterPodSet lives in a member cluster
+func memberPodSetKey(cr *appv1alpha1.MultiClusterPodSet, cluster appv1alpha1.MemberCluster) types.NamespacedName {
+	namespace := cluster.Namespace
+	if namespace == "" {
+		namespace = cr.Namespace
+	}
+	return types.NamespacedName{Namespace: namespace, Name: cr.Name}
+}
+
+// memberClient returns a client for the cluster described by a kubeconfig Secret,
+// reusing the last one as long as the Secret is unchanged. The cached metadata of the Secret
+// tells whether it changed, its data is only read when it did.
+func (r *MultiClusterPodSetReconciler) memberClient(ctx context.Context, namespace string, ref appv1alpha1.KubeconfigSecretReference) (client.Client, error) {
+	secretKey := types.NamespacedName{Namespace: namespace, Name: ref.Name}
+	secretMeta := &metav1.PartialObjectMetadata{}
+	secretMeta.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+	if err := r.Get(ctx, secretKey, secretMeta); err != nil {
+		return nil, err
+	}
+	key := ref.Key
+	if key == "" {
+		key = defaultKubeconfigKey
+	}
+	cacheKey := namespace + "/" + ref.Name + "/" + key
+	r.mu.Lock()
+	cached, ok := r.clients[cacheKey]
+	r.mu.Unlock()
+	if ok && cached.resourceVersion == secretMeta.ResourceVersion {
+		return cached.client, nil
+	}
+
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+	secret := &corev1.Secret{}
+	if err := reader.Get(ctx, secretKey, secret); err != nil {
+		return nil, err
+	}
+	kubeconfig, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no key %q", namespace, ref.Name, key)
+	}
+
+	// building the client talks to the member cluster, which mustn't hold up the other members
+	newClient := r.NewClusterClient
+	if newClient == nil {
+		newClient = r.newClusterClient
+	}
+	c, err := newClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clients == nil {
+		r.clients = map[string]memberClient{}
+	}
+	r.clients[cacheKey] = memberClient{resourceVersion: secret.ResourceVersion, client: c}
+	return c, nil
+}
+
+// newClusterClient builds an uncached client from a kubeconfig, with a short timeout so an
+// unreachable cluster doesn't hold up the others
+func (r *MultiClusterPodSetReconciler) newClusterClient(kubeconfig []byte) (client.Client, error) {
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	config.Timeout = memberClientTimeout
+	return client.New(config, client.Options{Scheme: r.Scheme})
+}
+
+// multiClusterPodSetsForSecret enqueues the MultiClusterPodSets using a kubeconfig Secret
+func (r *MultiClusterPodSetReconciler) multiClusterPodSetsForSecret(object client.Object) []reconcile.Request {
+	list := &appv1alpha1.MultiClusterPodSetList{}
+	if err := r.List(context.Background(), list, client.InNamespace(object.GetNamespace())); err != nil {
+		log.Log.Error(err, "unable to list MultiClusterPodSets", "Secret", object.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, item := range list.Items {
+		for _, cluster := range item.Spec.Clusters {
+			if cluster.KubeconfigSecret.Name == object.GetName() {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&item)})
+				break
+			}
+		}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *MultiClusterPodSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("multiclusterpodset-controller")
+	}
+	if r.APIReader == nil {
+		r.APIReader = mgr.GetAPIReader()
+	}
+	// only the metadata of Secrets is watched, their data is read when a kubeconfig changed
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&appv1alpha1.MultiClusterPodSet{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.multiClusterPodSetsForSecret), builder.OnlyMetadata).
+		Complete(r)
+}
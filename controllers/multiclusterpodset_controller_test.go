@@ -0,0 +1,138 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+// the suite's API server plays the hub, a second one is started as the member cluster
+var _ = Describe("MultiClusterPodSet controller", func() {
+	const namespace = "default"
+	ctx := context.Background()
+
+	var memberEnv *envtest.Environment
+	var memberClient client.Client
+	var reconciler *MultiClusterPodSetReconciler
+
+	BeforeEach(func() {
+		memberEnv = &envtest.Environment{
+			CRDDirectoryPaths:     []string{filepath.Join("..", "config", "crd", "bases")},
+			ErrorIfCRDPathMissing: true,
+		}
+		memberCfg, err := memberEnv.Start()
+		Expect(err).NotTo(HaveOccurred())
+		memberClient, err = client.New(memberCfg, client.Options{Scheme: scheme.Scheme})
+		Expect(err).NotTo(HaveOccurred())
+
+		user, err := memberEnv.ControlPlane.AddUser(envtest.User{Name: "hub", Groups: []string{"system:masters"}}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		kubeconfig, err := user.KubeConfig()
+		Expect(err).NotTo(HaveOccurred())
+
+		secrets := map[string][]byte{
+			"member-kubeconfig": kubeconfig,
+			// nothing listens on port 1, so this cluster is never reachable
+			"broken-kubeconfig": []byte("apiVersion: v1\nkind: Config\nclusters:\n- name: broken\n  cluster:\n    server: https://127.0.0.1:1\ncontexts:\n- name: broken\n  context:\n    cluster: broken\ncurrent-context: broken\n"),
+		}
+		for name, data := range secrets {
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Data:       map[string][]byte{defaultKubeconfigKey: data},
+			}
+			Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+		}
+
+		reconciler = &MultiClusterPodSetReconciler{Client: k8sClient, Scheme: scheme.Scheme, Recorder: record.NewFakeRecorder(100)}
+	})
+
+	AfterEach(func() {
+		for _, name := range []string{"member-kubeconfig", "broken-kubeconfig"} {
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+			Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, secret))).To(Succeed())
+		}
+		Expect(memberEnv.Stop()).To(Succeed())
+	})
+
+	It("moves the replicas of an unreachable cluster to the reachable one and cleans up on deletion", func() {
+		timeout := int32(1)
+		instance := &appv1alpha1.MultiClusterPodSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "spread", Namespace: namespace},
+			Spec: appv1alpha1.MultiClusterPodSetSpec{
+				Replicas:                4,
+				UnhealthyTimeoutSeconds: &timeout,
+				Clusters: []appv1alpha1.MemberCluster{
+					{Name: "member", Weight: 1, KubeconfigSecret: appv1alpha1.KubeconfigSecretReference{Name: "member-kubeconfig"}},
+					{Name: "broken", Weight: 1, KubeconfigSecret: appv1alpha1.KubeconfigSecretReference{Name: "broken-kubeconfig"}},
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, instance)).To(Succeed())
+		request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "spread", Namespace: namespace}}
+		memberKey := types.NamespacedName{Name: "spread", Namespace: namespace}
+
+		By("splitting the replicas by weight while the broken cluster is only degraded")
+		_, err := reconciler.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		podSet := &appv1alpha1.PodSet{}
+		Expect(memberClient.Get(ctx, memberKey, podSet)).To(Succeed())
+		Expect(podSet.Spec.Replicas).To(Equal(int32(2)))
+
+		By("moving all replicas once the broken cluster stays unreachable past the timeout")
+		Eventually(func() int32 {
+			// no operator runs in the member cluster, report its pods as ready in its place
+			Expect(memberClient.Get(ctx, memberKey, podSet)).To(Succeed())
+			podSet.Status.PodNames = []string{}
+			podSet.Status.ReadyReplicas = podSet.Spec.Replicas
+			Expect(memberClient.Status().Update(ctx, podSet)).To(Succeed())
+
+			_, err := reconciler.Reconcile(ctx, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(memberClient.Get(ctx, memberKey, podSet)).To(Succeed())
+			return podSet.Spec.Replicas
+		}, 10, 1).Should(Equal(int32(4)))
+
+		Expect(k8sClient.Get(ctx, request.NamespacedName, instance)).To(Succeed())
+		Expect(instance.Status.Clusters).To(HaveLen(2))
+		Expect(instance.Status.Clusters[1].Healthy).To(BeFalse())
+		Expect(instance.Status.Clusters[1].AssignedReplicas).To(BeZero())
+
+		By("deleting the member PodSet along with the MultiClusterPodSet")
+		// the broken cluster can't be cleaned up, dropping its Secret lets the deletion through
+		Expect(k8sClient.Delete(ctx, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "broken-kubeconfig", Namespace: namespace}})).To(Succeed())
+		Expect(k8sClient.Delete(ctx, instance)).To(Succeed())
+		_, err = reconciler.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors.IsNotFound(memberClient.Get(ctx, memberKey, podSet))).To(BeTrue())
+		Expect(errors.IsNotFound(k8sClient.Get(ctx, request.NamespacedName, instance))).To(BeTrue())
+	})
+})
@@ -0,0 +1,108 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+// nodePoolGroups turns the ordered node pools into placement groups.
+//
+// The replicas go to the first available pool. A pool whose pods stay unschedulable for
+// longer than its timeout keeps the pods that did get scheduled and the rest falls back to
+// the next pool. Once the timeout has passed again the pool is retried with all of the
+// replicas; as its new pods get scheduled the pods on the less preferred pools become
+// surplus and are removed, which migrates the PodSet back.
+func nodePoolGroups(cr *appv1alpha1.PodSet, pods []corev1.Pod, status *appv1alpha1.PodSetStatus, now time.Time) ([]placementGroup, time.Duration) {
+	pools := cr.Spec.NodePools
+
+	previous := map[string]*metav1.Time{}
+	for _, pool := range cr.Status.NodePools {
+		previous[pool.Name] = pool.UnavailableSince
+	}
+	podsByGroup := podsPerPlacementGroup(pods)
+
+	var requeueAfter time.Duration
+	groups := make([]placementGroup, len(pools))
+	status.NodePools = make([]appv1alpha1.NodePoolStatus, len(pools))
+	remaining := cr.Spec.Replicas
+	for i, pool := range pools {
+		poolPods := podsByGroup[pool.Name]
+		since, wait := groupUnavailableSince(previous[pool.Name], poolPods, unschedulableTimeout(pool.UnschedulableTimeoutSeconds), now)
+		requeueAfter = minRequeue(requeueAfter, wait)
+
+		// an unavailable pool only holds on to the pods that made it onto a node
+		desired := remaining
+		if since != nil {
+			if scheduled := countScheduledPods(poolPods); scheduled < desired {
+				desired = scheduled
+			}
+		}
+		remaining -= desired
+
+		groups[i] = placementGroup{
+			name:         pool.Name,
+			nodeSelector: pool.NodeSelector,
+			tolerations:  pool.Tolerations,
+			desired:      desired,
+		}
+		status.NodePools[i] = appv1alpha1.NodePoolStatus{
+			Name:             pool.Name,
+			Current:          int32(len(poolPods)),
+			UnavailableSince: since,
+		}
+	}
+	// with every pool out of capacity there is nothing to fall back to, wait on the preferred one
+	groups[0].desired += remaining
+	for i := range groups {
+		status.NodePools[i].Desired = groups[i].desired
+	}
+
+	status.PodPlacements = podPlacements(pods)
+	return groups, requeueAfter
+}
+
+// podPlacements records the node pool placement of every pod that was created for one
+func podPlacements(pods []corev1.Pod) []appv1alpha1.PodPlacement {
+	var placements []appv1alpha1.PodPlacement
+	for i := range pods {
+		pool, ok := pods[i].Labels[placementLabel]
+		if !ok {
+			continue
+		}
+		placement := appv1alpha1.PodPlacement{
+			PodName:  pods[i].Name,
+			NodePool: pool,
+			NodeName: pods[i].Spec.NodeName,
+		}
+		if since, ok := unschedulableSince(&pods[i]); ok {
+			unschedulable := metav1.NewTime(since)
+			placement.UnschedulableSince = &unschedulable
+		}
+		placements = append(placements, placement)
+	}
+	sort.Slice(placements, func(i, j int) bool {
+		return placements[i].PodName < placements[j].PodName
+	})
+	return placements
+}
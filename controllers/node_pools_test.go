@@ -0,0 +1,156 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+// poolPods makes pods on a node pool, the scheduled ones first and then the ones that have
+// been unschedulable since the given time
+func poolPods(pool string, scheduled, unschedulable int, since time.Time) []corev1.Pod {
+	var pods []corev1.Pod
+	for i := 0; i < scheduled+unschedulable; i++ {
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   fmt.Sprintf("%s-%d", pool, i),
+				Labels: map[string]string{placementLabel: pool},
+			},
+		}
+		if i < scheduled {
+			pod.Spec.NodeName = pool + "-node"
+			pod.Status.Phase = corev1.PodRunning
+		} else {
+			pod.Status.Phase = corev1.PodPending
+			pod.Status.Conditions = []corev1.PodCondition{{
+				Type:               corev1.PodScheduled,
+				Status:             corev1.ConditionFalse,
+				Reason:             corev1.PodReasonUnschedulable,
+				LastTransitionTime: metav1.NewTime(since),
+			}}
+		}
+		pods = append(pods, pod)
+	}
+	return pods
+}
+
+func TestNodePoolGroups(t *testing.T) {
+	now := time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	marked := func(d time.Duration) *metav1.Time {
+		since := metav1.NewTime(ago(d))
+		return &since
+	}
+	timeout := int32(60)
+
+	tests := []struct {
+		name string
+		pods []corev1.Pod
+		// unavailableSince is when each pool was marked in the previous status
+		unavailableSince []*metav1.Time
+
+		wantDesired     []int32
+		wantUnavailable []bool
+		wantRequeue     time.Duration
+	}{
+		{
+			name:            "replicas go to the first pool",
+			wantDesired:     []int32{4, 0},
+			wantUnavailable: []bool{false, false},
+		},
+		{
+			name:            "unschedulable within the timeout waits",
+			pods:            poolPods("spot", 1, 3, ago(20*time.Second)),
+			wantDesired:     []int32{4, 0},
+			wantUnavailable: []bool{false, false},
+			wantRequeue:     40 * time.Second,
+		},
+		{
+			name:            "unschedulable past the timeout falls back",
+			pods:            poolPods("spot", 1, 3, ago(2*time.Minute)),
+			wantDesired:     []int32{1, 3},
+			wantUnavailable: []bool{true, false},
+			wantRequeue:     time.Minute,
+		},
+		{
+			name:             "marked pool keeps its scheduled pods until the timeout passes again",
+			pods:             append(poolPods("spot", 1, 0, now), poolPods("on-demand", 3, 0, now)...),
+			unavailableSince: []*metav1.Time{marked(45 * time.Second), nil},
+			wantDesired:      []int32{1, 3},
+			wantUnavailable:  []bool{true, false},
+			wantRequeue:      15 * time.Second,
+		},
+		{
+			name:             "marked pool is retried with every replica",
+			pods:             append(poolPods("spot", 1, 0, now), poolPods("on-demand", 3, 0, now)...),
+			unavailableSince: []*metav1.Time{marked(2 * time.Minute), nil},
+			wantDesired:      []int32{4, 0},
+			wantUnavailable:  []bool{false, false},
+		},
+		{
+			name:            "every pool unavailable waits on the first one",
+			pods:            append(poolPods("spot", 0, 1, ago(2*time.Minute)), poolPods("on-demand", 1, 2, ago(2*time.Minute))...),
+			wantDesired:     []int32{3, 1},
+			wantUnavailable: []bool{true, true},
+			wantRequeue:     time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &appv1alpha1.PodSet{
+				Spec: appv1alpha1.PodSetSpec{
+					Replicas: 4,
+					NodePools: []appv1alpha1.NodePool{
+						{Name: "spot", NodeSelector: map[string]string{"pool": "spot"}, UnschedulableTimeoutSeconds: &timeout},
+						{Name: "on-demand", UnschedulableTimeoutSeconds: &timeout},
+					},
+				},
+			}
+			for i, since := range tt.unavailableSince {
+				cr.Status.NodePools = append(cr.Status.NodePools, appv1alpha1.NodePoolStatus{Name: cr.Spec.NodePools[i].Name, UnavailableSince: since})
+			}
+
+			status := &appv1alpha1.PodSetStatus{}
+			groups, requeueAfter := nodePoolGroups(cr, tt.pods, status, now)
+
+			if len(groups) != len(tt.wantDesired) {
+				t.Fatalf("got %d groups, want %d", len(groups), len(tt.wantDesired))
+			}
+			for i, group := range groups {
+				if group.name != cr.Spec.NodePools[i].Name {
+					t.Errorf("group %d is %s, want %s", i, group.name, cr.Spec.NodePools[i].Name)
+				}
+				if group.desired != tt.wantDesired[i] || status.NodePools[i].Desired != tt.wantDesired[i] {
+					t.Errorf("pool %s desired = %d (status %d), want %d", group.name, group.desired, status.NodePools[i].Desired, tt.wantDesired[i])
+				}
+				if unavailable := status.NodePools[i].UnavailableSince != nil; unavailable != tt.wantUnavailable[i] {
+					t.Errorf("pool %s unavailable = %v, want %v", group.name, unavailable, tt.wantUnavailable[i])
+				}
+			}
+			if requeueAfter != tt.wantRequeue {
+				t.Errorf("requeue after %s, want %s", requeueAfter, tt.wantRequeue)
+			}
+		})
+	}
+}
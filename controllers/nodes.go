@@ -0,0 +1,118 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// podNodeNameField indexes pods by the node they are bound to
+const podNodeNameField = "spec.nodeName"
+
+// indexPodNodeName is the indexer function for podNodeNameField
+func indexPodNodeName(obj client.Object) []string {
+	pod := obj.(*corev1.Pod)
+	if pod.Spec.NodeName == "" {
+		return nil
+	}
+	return []string{pod.Spec.NodeName}
+}
+
+// podRequests sums up the resources requested by the pod. Init containers run one after the
+// other, so they only count with their largest request if it exceeds the regular containers.
+func podRequests(pod *corev1.Pod) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	for _, container := range pod.Spec.Containers {
+		addResources(requests, container.Resources.Requests)
+	}
+	for _, container := range pod.Spec.InitContainers {
+		for name, quantity := range container.Resources.Requests {
+			if current, ok := requests[name]; !ok || quantity.Cmp(current) > 0 {
+				requests[name] = quantity.DeepCopy()
+			}
+		}
+	}
+	addResources(requests, pod.Spec.Overhead)
+	return requests
+}
+
+// addResources adds every quantity of extra to total
+func addResources(total, extra corev1.ResourceList) {
+	for name, quantity := range extra {
+		current := total[name]
+		current.Add(quantity)
+		total[name] = current
+	}
+}
+
+// subtractResources removes every quantity of extra from total
+func subtractResources(total, extra corev1.ResourceList) {
+	for name, quantity := range extra {
+		current := total[name]
+		current.Sub(quantity)
+		total[name] = current
+	}
+}
+
+// isPodTerminal tells whether the pod no longer occupies resources on its node
+func isPodTerminal(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+// nodeRequested sums up the requests of all pods occupying the node, as seen by the cache,
+// and counts those pods
+func nodeRequested(ctx context.Context, c client.Reader, nodeName string) (corev1.ResourceList, int64, error) {
+	podList := &corev1.PodList{}
+	if err := c.List(ctx, podList, client.MatchingFields{podNodeNameField: nodeName}); err != nil {
+		return nil, 0, err
+	}
+	requested := corev1.ResourceList{}
+	var pods int64
+	for i := range podList.Items {
+		if isPodTerminal(&podList.Items[i]) {
+			continue
+		}
+		addResources(requested, podRequests(&podList.Items[i]))
+		pods++
+	}
+	return requested, pods, nil
+}
+
+// utilization is the highest fraction of the node's allocatable cpu or memory that is requested
+func utilization(requested, allocatable corev1.ResourceList) float64 {
+	var highest float64
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		capacity, ok := allocatable[name]
+		if !ok || capacity.IsZero() {
+			continue
+		}
+		used := requested[name]
+		if fraction := quantityRatio(used, capacity); fraction > highest {
+			highest = fraction
+		}
+	}
+	return highest
+}
+
+// quantityRatio divides two quantities
+func quantityRatio(a, b resource.Quantity) float64 {
+	return float64(a.MilliValue()) / float64(b.MilliValue())
+}
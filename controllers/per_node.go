@@ -0,0 +1,158 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+// isPerNode tells whether the PodSet runs a pod on every eligible node
+func isPerNode(cr *appv1alpha1.PodSet) bool {
+	return cr.Spec.PlacementMode == appv1alpha1.PerNodePlacementMode && features.Enabled(features.PerNodePlacement)
+}
+
+// perNodeTargets lists the nodes a PerNode PodSet runs a pod on: the schedulable ones matching
+// its node selector whose labels and taints the template's pods accept
+func (r *PodSetReconciler) perNodeTargets(ctx context.Context, cr *appv1alpha1.PodSet) ([]string, error) {
+	nodeList := &corev1.NodeList{}
+	if err := r.Client.List(ctx, nodeList, client.MatchingLabels(cr.Spec.NodeSelector)); err != nil {
+		return nil, err
+	}
+	template := &corev1.Pod{Spec: podTemplate(cr).Spec}
+	var nodes []string
+	for i := range nodeList.Items {
+		node := &nodeList.Items[i]
+		if node.Spec.Unschedulable || node.DeletionTimestamp != nil || !(&nodeCapacity{node: node}).accepts(template) {
+			continue
+		}
+		nodes = append(nodes, node.Name)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// perNodeGroups has a group of one pod bound to each of the nodes
+func perNodeGroups(nodes []string) []placementGroup {
+	groups := make([]placementGroup, 0, len(nodes))
+	for _, node := range nodes {
+		groups = append(groups, placementGroup{name: perNodeGroupName(node), node: node, desired: 1})
+	}
+	return groups
+}
+
+// perNodeGroupName is the name of the group bound to the node, the slash keeps it apart from
+// the names of the other kinds of groups
+func perNodeGroupName(node string) string {
+	return "node/" + node
+}
+
+// capPodsPerNode splits off the pods beyond maxPerNode on each node, the newest ones first
+func capPodsPerNode(cr *appv1alpha1.PodSet, pods []corev1.Pod) (kept, excess []corev1.Pod) {
+	if cr.Spec.MaxPerNode == nil || isPerNode(cr) {
+		return pods, nil
+	}
+	sorted := append([]corev1.Pod(nil), pods...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].CreationTimestamp.Before(&sorted[j].CreationTimestamp)
+	})
+	perNode := map[string]int32{}
+	for _, pod := range sorted {
+		if isPodScheduled(&pod) {
+			if perNode[pod.Spec.NodeName] >= *cr.Spec.MaxPerNode {
+				excess = append(excess, pod)
+				continue
+			}
+			perNode[pod.Spec.NodeName]++
+		}
+		kept = append(kept, pod)
+	}
+	return kept, excess
+}
+
+// keepOffFullNodes keeps a new pod of a PodSet with maxPerNode off the nodes already running
+// that many of its pods. Pods still waiting for a node can end up on the same one, the ones
+// beyond the cap are replaced once they are scheduled.
+func keepOffFullNodes(cr *appv1alpha1.PodSet, pod *corev1.Pod, pods []corev1.Pod) {
+	if cr.Spec.MaxPerNode == nil || isPerNode(cr) {
+		return
+	}
+	perNode := map[string]int32{}
+	for i := range pods {
+		if isPodScheduled(&pods[i]) {
+			perNode[pods[i].Spec.NodeName]++
+		}
+	}
+	var full []string
+	for node, count := range perNode {
+		if count >= *cr.Spec.MaxPerNode {
+			full = append(full, node)
+		}
+	}
+	if len(full) == 0 {
+		return
+	}
+	sort.Strings(full)
+	requireNodes(pod, corev1.NodeSelectorTerm{MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpNotIn, Values: full}}})
+}
+
+// perNodePodSets maps a node to the PerNode PodSets, which may have to add or remove its pod
+func (r *PodSetReconciler) perNodePodSets(object client.Object) []reconcile.Request {
+	list := &appv1alpha1.PodSetList{}
+	if err := r.List(context.Background(), list); err != nil {
+		log.Log.Error(err, "unable to list PodSets", "Node", object.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, item := range list.Items {
+		if isPerNode(&item) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&item)})
+		}
+	}
+	return requests
+}
+
+// nodeEligibilityChanged lets through the node events that can change which nodes a PerNode
+// PodSet runs on, the frequent status updates of the nodes are ignored
+var nodeEligibilityChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldNode, ok := e.ObjectOld.(*corev1.Node)
+		if !ok {
+			return false
+		}
+		newNode, ok := e.ObjectNew.(*corev1.Node)
+		if !ok {
+			return false
+		}
+		return !labels.Equals(oldNode.Labels, newNode.Labels) ||
+			oldNode.Spec.Unschedulable != newNode.Spec.Unschedulable ||
+			!reflect.DeepEqual(oldNode.Spec.Taints, newNode.Spec.Taints) ||
+			(oldNode.DeletionTimestamp == nil) != (newNode.DeletionTimestamp == nil)
+	},
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+// defaultUnschedulableTimeout is how long pods may wait for capacity before their
+// placement is given up on, unless the PodSet says otherwise
+const defaultUnschedulableTimeout = 300 * time.Second
+
+// placementGroup is a set of pods sharing the same scheduling constraints, e.g. one
+// variant of a capacity mix. A PodSet without any placement configuration has a
+// single unnamed group holding all of its pods.
+type placementGroup struct {
+	name         string
+	nodeSelector map[string]string
+	tolerations  []corev1.Toleration
+	// node is the node the group's pods are bound to, for the groups of a PerNode PodSet
+	node    string
+	desired int32
+}
+
+// applyTo adds the group's label and scheduling constraints to a new pod
+func (g *placementGroup) applyTo(pod *corev1.Pod) {
+	if g.node != "" {
+		// node names can be longer than a label value, so they are kept in an annotation
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[placementNodeAnnotation] = g.node
+		requireNodes(pod, corev1.NodeSelectorTerm{MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{g.node}}}})
+	} else if g.name != "" {
+		pod.Labels[placementLabel] = g.name
+	}
+	if len(g.nodeSelector) > 0 {
+		if pod.Spec.NodeSelector == nil {
+			pod.Spec.NodeSelector = map[string]string{}
+		}
+		for key, value := range g.nodeSelector {
+			pod.Spec.NodeSelector[key] = value
+		}
+	}
+	pod.Spec.Tolerations = append(pod.Spec.Tolerations, g.tolerations...)
+}
+
+// placementGroups works out the groups the PodSet's pods should be spread across and how
+// many pods each of them should hold, recording the per-group state in status.
+// A non-zero duration asks for the groups to be re-evaluated after that long. The nodes are
+// the ones a PerNode PodSet runs a pod on.
+func (r *PodSetReconciler) placementGroups(cr *appv1alpha1.PodSet, nodes []string, pods []corev1.Pod, status *appv1alpha1.PodSetStatus, now time.Time) ([]placementGroup, time.Duration) {
+	if isPerNode(cr) {
+		return perNodeGroups(nodes), 0
+	}
+	if cr.Spec.CapacityMix != nil && len(cr.Spec.CapacityMix.Variants) > 0 {
+		return capacityMixGroups(cr, pods, status, now)
+	}
+	if len(cr.Spec.NodePools) > 0 {
+		return nodePoolGroups(cr, pods, status, now)
+	}
+	return []placementGroup{{desired: cr.Spec.Replicas}}, 0
+}
+
+// podsPerPlacementGroup buckets the pods by the placement group they were created for
+func podsPerPlacementGroup(pods []corev1.Pod) map[string][]corev1.Pod {
+	groups := map[string][]corev1.Pod{}
+	for _, pod := range pods {
+		name := pod.Labels[placementLabel]
+		if node := pod.Annotations[placementNodeAnnotation]; node != "" {
+			name = perNodeGroupName(node)
+		}
+		groups[name] = append(groups[name], pod)
+	}
+	return groups
+}
+
+// groupUnavailableSince decides whether a placement group ran out of capacity. A group is
+// marked as soon as one of its pods stays unschedulable for longer than the timeout and is
+// given another chance once the timeout has passed again since it was marked.
+// The returned duration is when the decision may change next.
+func groupUnavailableSince(previous *metav1.Time, pods []corev1.Pod, timeout time.Duration, now time.Time) (*metav1.Time, time.Duration) {
+	if previous != nil {
+		if wait := timeout - now.Sub(previous.Time); wait > 0 {
+			return previous, wait
+		}
+	}
+
+	var requeueAfter time.Duration
+	for i := range pods {
+		pendingSince, ok := unschedulableSince(&pods[i])
+		if !ok {
+			continue
+		}
+		if wait := timeout - now.Sub(pendingSince); wait > 0 {
+			requeueAfter = minRequeue(requeueAfter, wait)
+			continue
+		}
+		marked := metav1.NewTime(now).Rfc3339Copy()
+		return &marked, timeout
+	}
+	return nil, requeueAfter
+}
+
+// unschedulableTimeout turns an optional number of seconds into a timeout
+func unschedulableTimeout(seconds *int32) time.Duration {
+	if seconds == nil {
+		return defaultUnschedulableTimeout
+	}
+	return time.Duration(*seconds) * time.Second
+}
+
+// distributeReplicas splits the replicas proportionally to the weights using the largest
+// remainder method, so the shares always add up to the replica count
+func distributeReplicas(replicas int32, weights []int32) []int32 {
+	shares := make([]int32, len(weights))
+	if len(weights) == 0 {
+		return shares
+	}
+	var total int64
+	for _, weight := range weights {
+		total += int64(weight)
+	}
+	// all weights being zero means there is no preference, split evenly
+	if total == 0 {
+		weights = make([]int32, len(weights))
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = int64(len(weights))
+	}
+
+	type remainder struct {
+		index int
+		value int64
+	}
+	remainders := make([]remainder, len(weights))
+	var assigned int32
+	for i, weight := range weights {
+		share := int64(replicas) * int64(weight)
+		shares[i] = int32(share / total)
+		remainders[i] = remainder{index: i, value: share % total}
+		assigned += shares[i]
+	}
+	sort.SliceStable(remainders, func(i, j int) bool {
+		return remainders[i].value > remainders[j].value
+	})
+	for i := 0; assigned < replicas; i++ {
+		shares[remainders[i%len(remainders)].index]++
+		assigned++
+	}
+	return shares
+}
+
+// minRequeue returns the earliest of two requeue delays, zero meaning no requeue
+func minRequeue(current, next time.Duration) time.Duration {
+	if next <= 0 {
+		return current
+	}
+	if current == 0 || next < current {
+		return next
+	}
+	return current
+}
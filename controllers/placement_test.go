@@ -0,0 +1,58 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDistributeReplicas(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas int32
+		weights  []int32
+		want     []int32
+	}{
+		{name: "no groups", replicas: 3, weights: nil, want: []int32{}},
+		{name: "single group", replicas: 5, weights: []int32{3}, want: []int32{5}},
+		{name: "even split", replicas: 6, weights: []int32{1, 1, 1}, want: []int32{2, 2, 2}},
+		{name: "proportional", replicas: 10, weights: []int32{3, 1, 1}, want: []int32{6, 2, 2}},
+		{name: "largest remainder wins", replicas: 4, weights: []int32{2, 1}, want: []int32{3, 1}},
+		{name: "tied remainders go in order", replicas: 4, weights: []int32{1, 1, 1}, want: []int32{2, 1, 1}},
+		{name: "zero weight gets nothing", replicas: 5, weights: []int32{1, 0, 1}, want: []int32{3, 0, 2}},
+		{name: "all zero weights split evenly", replicas: 5, weights: []int32{0, 0}, want: []int32{3, 2}},
+		{name: "fewer replicas than groups", replicas: 2, weights: []int32{1, 1, 1}, want: []int32{1, 1, 0}},
+		{name: "no replicas", replicas: 0, weights: []int32{1, 2}, want: []int32{0, 0}},
+		{name: "large weights don't overflow", replicas: 1000, weights: []int32{1 << 30, 1 << 30}, want: []int32{500, 500}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := distributeReplicas(tt.replicas, tt.weights)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("distributeReplicas(%d, %v) = %v, want %v", tt.replicas, tt.weights, got, tt.want)
+			}
+			var sum int32
+			for _, share := range got {
+				sum += share
+			}
+			if len(tt.weights) > 0 && sum != tt.replicas {
+				t.Errorf("shares add up to %d, want %d", sum, tt.replicas)
+			}
+		})
+	}
+}
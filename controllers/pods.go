@@ -0,0 +1,84 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// isPodScheduled tells whether the pod has been bound to a node
+func isPodScheduled(pod *corev1.Pod) bool {
+	return pod.Spec.NodeName != ""
+}
+
+// unschedulableSince returns the time the scheduler first failed to place the pod,
+// the second return value is false if the pod isn't waiting for capacity
+func unschedulableSince(pod *corev1.Pod) (time.Time, bool) {
+	if pod.Status.Phase != corev1.PodPending || isPodScheduled(pod) {
+		return time.Time{}, false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse &&
+			condition.Reason == corev1.PodReasonUnschedulable {
+			return condition.LastTransitionTime.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// countScheduledPods counts the pods that have been bound to a node
+func countScheduledPods(pods []corev1.Pod) int32 {
+	var scheduled int32
+	for i := range pods {
+		if isPodScheduled(&pods[i]) {
+			scheduled++
+		}
+	}
+	return scheduled
+}
+
+// sortUnscheduledFirst orders the pods so that the ones still waiting for a node come first,
+// they are the cheapest to get rid of
+func sortUnscheduledFirst(pods []corev1.Pod) {
+	sort.SliceStable(pods, func(i, j int) bool {
+		return !isPodScheduled(&pods[i]) && isPodScheduled(&pods[j])
+	})
+}
+
+// isPodReady tells whether the pod reports itself as ready
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// countReadyPods counts the pods that report themselves as ready
+func countReadyPods(pods []corev1.Pod) int32 {
+	var ready int32
+	for i := range pods {
+		if isPodReady(&pods[i]) {
+			ready++
+		}
+	}
+	return ready
+}
@@ -19,17 +19,27 @@ package controllers
 import (
 	"context"
 	"reflect"
+	"sync"
+	"time"
 
 	// don't forget to add the particular version of the API in the import path
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
 )
@@ -38,11 +48,44 @@ import (
 type PodSetReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// VictimRankers are the scale-down strategies PodSets can choose from,
+	// DefaultVictimRankers is used when left empty
+	VictimRankers map[appv1alpha1.VictimRanking]VictimRanker
+
+	// Recorder emits the PodSet's events, the manager's recorder is used when left empty
+	Recorder record.EventRecorder
+
+	// APIReader reads hook Jobs past the cache, which may not have seen a Job that was just
+	// created. The Client is used when left empty.
+	APIReader client.Reader
+
+	// LegacyLabelSelection also picks up pods that only carry the unprefixed app label
+	// they were created with before the managed label keys were prefixed
+	LegacyLabelSelection bool
+
+	// CreatorServiceAccount is the ServiceAccount, in each PodSet's namespace, impersonated
+	// to create pods unless the PodSet names its own. Empty creates them as the operator.
+	CreatorServiceAccount string
+	// RestConfig is what impersonating clients are built from, the manager's config is used when left empty
+	RestConfig *rest.Config
+
+	creatorsMu sync.Mutex
+	creators   map[types.NamespacedName]impersonatingClient
+
+	coreMu sync.Mutex
+	core   rest.Interface
 }
 
 //+kubebuilder:rbac:groups=app.github.com,resources=podsets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=app.github.com,resources=podsets/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=app.github.com,resources=podsets/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=controllerrevisions,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -61,30 +104,57 @@ func (r *PodSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	// context.TODO() is passed when we might have to cancel some long running task mid-way
 	err := r.Client.Get(context.TODO(), req.NamespacedName, instance)
 	if err != nil {
+		if errors.IsNotFound(err) {
+			// the PodSet is gone, only what is kept about it in memory is left to clean up
+			forgetTopologyMetrics(req.NamespacedName)
+			r.forgetPodCreator(req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
 		return ctrl.Result{}, err
 	}
 
-	// now, from the instance, we need to get the list of pods
-	podList := &corev1.PodList{}
+	// a temporary scale overrides the replica count until it expires, the rest of the
+	// reconcile works against the replica count in effect
+	replicas, temporaryScale, temporaryScaleWait, err := r.syncTemporaryScale(ctx, instance, time.Now())
+	if err != nil {
+		log.Log.Error(err, "Failed to sync the temporary scale of PodSet")
+		return ctrl.Result{}, err
+	}
+	instance.Spec.Replicas = replicas
+
+	// a PerNode PodSet runs a pod on every eligible node instead
+	var perNodes []string
+	if isPerNode(instance) {
+		if perNodes, err = r.perNodeTargets(ctx, instance); err != nil {
+			log.Log.Error(err, "Failed to list the nodes of PodSet")
+			return ctrl.Result{}, err
+		}
+		instance.Spec.Replicas = int32(len(perNodes))
+	}
 
-	// the pods are to be selected according to the labels
-	labelSelectorSet := map[string]string{
-		"app":     instance.Name,
-		"version": "v0.1",
+	// now, from the instance, we need to get the list of pods, they are selected by the UID
+	// of the PodSet so that pods of other tooling sharing a generic label aren't picked up
+	pods, err := r.listPods(ctx, instance)
+	if err != nil {
+		return ctrl.Result{}, err
 	}
-	labelSelector := labels.SelectorFromSet(labelSelectorSet)
 
-	// obtain the list options
-	listOptions := &client.ListOptions{LabelSelector: labelSelector, Namespace: instance.Namespace}
+	// relabel the pods with the current version and migrate the ones left behind with the old unprefixed labels
+	ownedPods, err := r.syncPodLabels(ctx, instance, pods)
+	if err != nil {
+		log.Log.Error(err, "Failed to sync the labels of the PodSet's Pods")
+		return ctrl.Result{}, err
+	}
 
-	// obtain the podList from the client after giving it the listOptions
-	if err = r.Client.List(context.TODO(), podList, listOptions); err != nil {
+	// pods annotated for quarantine are set aside for inspection, which gets them replaced
+	if ownedPods, err = r.quarantinePods(ctx, instance, ownedPods, time.Now()); err != nil {
+		log.Log.Error(err, "Failed to quarantine Pods of the PodSet")
 		return ctrl.Result{}, err
 	}
 
 	// from the podList, identify the available pods according to their phase i.e., PodRunning or PodPending
 	var availablePods []corev1.Pod
-	for _, pod := range podList.Items {
+	for _, pod := range ownedPods {
 		if pod.ObjectMeta.DeletionTimestamp != nil {
 			continue
 		}
@@ -93,7 +163,6 @@ func (r *PodSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		}
 	}
 
-	currentAvailablePods := int32(len(availablePods))
 	availablePodNames := []string{}
 
 	// get the names of the available pods
@@ -103,7 +172,181 @@ func (r *PodSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 
 	// after we know which and how many pods are available, the controller can act upon the current state by updating the status
 	status := appv1alpha1.PodSetStatus{
-		PodNames: availablePodNames,
+		PodNames:          availablePodNames,
+		ReadyReplicas:     countReadyPods(availablePods),
+		PodVersions:       podVersions(availablePods),
+		TemporaryScale:    temporaryScale,
+		CapacityShortfall: instance.Status.CapacityShortfall,
+		Conditions:        append([]metav1.Condition(nil), instance.Status.Conditions...),
+	}
+
+	// pods that got extra CPU to start get it taken away once they are ready
+	boostWait, err := r.endStartupBoosts(ctx, instance, availablePods, time.Now())
+	if err != nil {
+		log.Log.Error(err, "Failed to end the startup boost of Pods of the PodSet")
+		return ctrl.Result{}, err
+	}
+
+	// one ready pod is labelled as the leader, if the PodSet elects one
+	if status.Leader, err = r.electLeader(ctx, instance, availablePods); err != nil {
+		log.Log.Error(err, "Failed to elect the leader of PodSet")
+		return ctrl.Result{}, err
+	}
+
+	// work out where the pods should be placed, e.g. across the variants of a capacity mix
+	groups, requeueAfter := r.placementGroups(instance, perNodes, availablePods, &status, time.Now())
+
+	// quarantined pods are deleted once their time is up
+	quarantineWait, err := r.expireQuarantinedPods(ctx, instance, &status, time.Now())
+	if err != nil {
+		log.Log.Error(err, "Failed to expire the quarantined Pods of the PodSet")
+		return ctrl.Result{}, err
+	}
+	requeueAfter = minRequeue(requeueAfter, quarantineWait)
+	requeueAfter = minRequeue(requeueAfter, temporaryScaleWait)
+	requeueAfter = minRequeue(requeueAfter, boostWait)
+
+	// pods stuck terminating on a lost node are force-deleted, if the PodSet opted in
+	stuckWait, err := r.forceDeleteStuckPods(ctx, instance, ownedPods, time.Now())
+	if err != nil {
+		log.Log.Error(err, "Failed to force-delete the stuck Pods of the PodSet")
+		return ctrl.Result{}, err
+	}
+	requeueAfter = minRequeue(requeueAfter, stuckWait)
+
+	// pods get their PVCs from the volume claim templates, cloned from a ready pod if asked to
+	claimWait, err := r.syncVolumeClaims(ctx, instance, availablePods, &status, time.Now())
+	if err != nil {
+		log.Log.Error(err, "Failed to create the PVCs of the Pods of the PodSet")
+		return ctrl.Result{}, err
+	}
+	requeueAfter = minRequeue(requeueAfter, claimWait)
+
+	// pods created from an older template are replaced by pods of the current revision
+	revision := templateRevision(podTemplate(instance))
+	updatedPods, outdatedPods := splitByRevision(instance, availablePods, revision)
+	if status.CurrentRevisionNumber, err = r.syncRevisionHistory(ctx, instance, podTemplate(instance), revision); err != nil {
+		log.Log.Error(err, "Failed to record the revision history of PodSet")
+		return ctrl.Result{}, err
+	}
+	status.CurrentRevision = revision
+	status.UpdatedReplicas = int32(len(updatedPods))
+
+	// break the pods down by zone and node, so a degraded zone shows which part of the PodSet it hits
+	if status.Zones, status.Nodes, err = r.topologyStatus(ctx, availablePods, updatedPods); err != nil {
+		log.Log.Error(err, "Failed to break down the Pods of PodSet by topology")
+		return ctrl.Result{}, err
+	}
+	recordTopologyMetrics(instance, status.Zones, status.Nodes)
+
+	// pods the rebalancer is moving to another zone or node are counted as their replacements
+	updatedPods, rebalanceWait, err := r.syncRebalanceMoves(ctx, instance, updatedPods, groups, time.Now())
+	if err != nil {
+		log.Log.Error(err, "Failed to move Pods of the PodSet for rebalancing")
+		return ctrl.Result{}, err
+	}
+	requeueAfter = minRequeue(requeueAfter, rebalanceWait)
+
+	// track availability against the SLO, an exhausted error budget may hold back rollouts
+	sloWait := sampleSLO(instance, status.ReadyReplicas, instance.Spec.Replicas, &status, time.Now())
+	requeueAfter = minRequeue(requeueAfter, sloWait)
+
+	// the rollout of a new revision waits for the error budget, for its pre-rollout hook and for its
+	// images to be on the nodes. While it is held back the outdated pods are kept and still count
+	// towards the replicas, only replacing them waits.
+	status.PrePull = instance.Status.PrePull
+	for _, hooks := range instance.Status.RolloutHooks {
+		status.RolloutHooks = append(status.RolloutHooks, *hooks.DeepCopy())
+	}
+	rolloutBlocked := false
+	if len(outdatedPods) > 0 {
+		proceed := !errorBudgetExhausted(instance, &status)
+		if proceed {
+			if proceed, err = r.preRolloutHook(ctx, instance, revision, &status); err != nil {
+				log.Log.Error(err, "Failed to run the pre-rollout hook of the PodSet")
+				return ctrl.Result{}, err
+			}
+		}
+		if proceed {
+			var wait time.Duration
+			if proceed, wait, err = r.prePullImages(ctx, instance, revision, groups, &status); err != nil {
+				log.Log.Error(err, "Failed to pre-pull the images of the PodSet")
+				return ctrl.Result{}, err
+			}
+			requeueAfter = minRequeue(requeueAfter, wait)
+		}
+		rolloutBlocked = !proceed
+	} else {
+		// a pre-pull left behind by an abandoned rollout is no longer needed
+		if err = r.cleanupPrePull(ctx, instance, ""); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err = r.postRolloutHook(ctx, instance, revision, updatedPods, &status); err != nil {
+			log.Log.Error(err, "Failed to run the post-rollout hook of the PodSet")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// pods lost while the rollout is held back are replaced from the revision that was rolled out last
+	countedPods := updatedPods
+	newPodTemplate, newPodRevision := podTemplate(instance), revision
+	if rolloutBlocked {
+		countedPods = append(append([]corev1.Pod(nil), updatedPods...), outdatedPods...)
+		if newPodTemplate, newPodRevision, err = r.rolledOutTemplate(ctx, instance, outdatedPods); err != nil {
+			log.Log.Error(err, "Failed to look up the rolled out revision of PodSet")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// pods beyond maxPerNode on a node are surplus, they are replaced by pods kept off the full nodes
+	countedPods, surplusPods := capPodsPerNode(instance, countedPods)
+	if !rolloutBlocked {
+		surplusPods = append(surplusPods, outdatedPods...)
+	}
+
+	// compare every placement group against its desired number of pods
+	podsByGroup := podsPerPlacementGroup(countedPods)
+	ranker := r.victimRanker(instance)
+	missingPods := make([]int32, len(groups))
+	knownGroups := map[string]bool{}
+	for i, group := range groups {
+		knownGroups[group.name] = true
+		groupPods := podsByGroup[group.name]
+		current := int32(len(groupPods))
+		if current > group.desired {
+			if groupPods, err = ranker.Rank(ctx, groupPods); err != nil {
+				log.Log.Error(err, "Failed to rank the Pods of the PodSet for scale-down")
+				return ctrl.Result{}, err
+			}
+			surplusPods = append(surplusPods, groupPods[:current-group.desired]...)
+		}
+		if current < group.desired {
+			missingPods[i] = group.desired - current
+		}
+	}
+	// pods of groups that are no longer part of the spec are all surplus
+	for name, groupPods := range podsByGroup {
+		if !knownGroups[name] {
+			surplusPods = append(surplusPods, groupPods...)
+		}
+	}
+	// without the template of the rolled out revision, lost pods can only be replaced once the rollout goes ahead
+	if newPodTemplate == nil {
+		log.Log.Info("Rolled out revision of PodSet is no longer in its history, not replacing lost Pods", "PodSet", instance.Name)
+		missingPods = make([]int32, len(groups))
+	}
+
+	// make sure the missing pods fit on the cluster before creating them
+	if missingPods, err = r.checkCapacity(ctx, instance, groups, missingPods, &status); err != nil {
+		log.Log.Error(err, "Failed to check the capacity for scaling up PodSet")
+		return ctrl.Result{}, err
+	}
+	if status.CapacityShortfall > 0 {
+		requeueAfter = minRequeue(requeueAfter, capacityRecheckInterval)
+	}
+	scalingUp := false
+	for _, missing := range missingPods {
+		scalingUp = scalingUp || missing > 0
 	}
 
 	// check if desired status is equal to the current state
@@ -116,53 +359,124 @@ func (r *PodSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		}
 	}
 
-	// if there are more pods than number of specified replicas --> scale down
-	if currentAvailablePods > instance.Spec.Replicas {
-		log.Log.Info("Scaling down PodSet", "currently available", currentAvailablePods, "required", instance.Spec.Replicas)
-		difference := currentAvailablePods - instance.Spec.Replicas
-		podsToBeDestroyed := availablePods[:difference]
-		for _, soonToBeDestroyedPod := range podsToBeDestroyed {
-			err = r.Client.Delete(context.TODO(), &soonToBeDestroyedPod)
-			if err != nil{
-				log.Log.Error(err, "Failed to delete Pod from PodSet", soonToBeDestroyedPod.Name)
+	// if there are less pods than desired in a group --> scale up
+	// pods are created as the PodSet's creator ServiceAccount, if it has one
+	creator, err := r.podCreator(instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	for i, missing := range missingPods {
+		if missing == 0 {
+			continue
+		}
+		log.Log.Info("Scaling up PodSet", "group", groups[i].name, "missing", missing, "required", instance.Spec.Replicas)
+		for ; missing > 0; missing-- {
+			pod := r.newPodFromTemplate(instance, newPodTemplate, newPodRevision)
+			groups[i].applyTo(pod)
+			keepOffFullNodes(instance, pod, availablePods)
+
+			// set PodSet instance as the owner and controller
+			if err = controllerutil.SetControllerReference(instance, pod, r.Scheme); err != nil {
+				return ctrl.Result{}, err
+			}
+			err = creator.Create(context.TODO(), pod)
+			if err != nil {
+				log.Log.Error(err, "Failed to create a new Pod for the PodSet custom resource")
+				if errors.IsForbidden(err) {
+					r.Recorder.Eventf(instance, corev1.EventTypeWarning, "FailedCreate", "Error creating pod: %v", err)
+				}
 				return ctrl.Result{}, err
 			}
 		}
-		return ctrl.Result{Requeue: true}, nil
 	}
 
-	// if there are less pods than number of specified replicas --> scale up
-	if currentAvailablePods < instance.Spec.Replicas {
-		log.Log.Info("Scaling up PodSet", "currently available", currentAvailablePods, "required", instance.Spec.Replicas)
-		pod := r.newPodForPodSetCustomResource(instance)
-
-		// set PodSet instance as the owner and controller
-		if err = controllerutil.SetControllerReference(instance, pod, r.Scheme); err != nil {
-			return ctrl.Result{}, err
-		}
-		err = r.Client.Create(context.TODO(), pod)
-		if err != nil {
-			log.Log.Error(err, "Failed to create a new Pod for the PodSet custom resource")
-			return ctrl.Result{}, err
+	// if there are more pods than desired in a group --> scale down
+	// scheduled pods are only removed while enough other pods are scheduled to keep the
+	// replica count, so that moving pods between groups never drops below it
+	scalingDown := false
+	if len(surplusPods) > 0 {
+		log.Log.Info("Scaling down PodSet", "surplus", len(surplusPods), "required", instance.Spec.Replicas)
+		budget := countScheduledPods(availablePods) - instance.Spec.Replicas
+		sortUnscheduledFirst(surplusPods)
+		for _, soonToBeDestroyedPod := range surplusPods {
+			if isPodScheduled(&soonToBeDestroyedPod) {
+				if budget <= 0 {
+					continue
+				}
+				budget--
+			}
+			err = r.Client.Delete(context.TODO(), &soonToBeDestroyedPod)
+			if err != nil && !errors.IsNotFound(err) {
+				log.Log.Error(err, "Failed to delete Pod from PodSet", "pod", soonToBeDestroyedPod.Name)
+				return ctrl.Result{}, err
+			}
+			scalingDown = true
 		}
+	}
+
+	// surplus that had to be kept is picked up again once the pods replacing it get scheduled
+	if scalingUp || scalingDown {
 		return ctrl.Result{Requeue: true}, nil
 	}
+	if requeueAfter > 0 {
+		return ctrl.Result{RequeueAfter: requeueAfter}, nil
+	}
 	return reconcile.Result{}, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *PodSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.VictimRankers == nil {
+		r.VictimRankers = DefaultVictimRankers(mgr.GetClient())
+	}
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("podset-controller")
+	}
+	if r.RestConfig == nil {
+		r.RestConfig = mgr.GetConfig()
+	}
+	if r.APIReader == nil {
+		r.APIReader = mgr.GetAPIReader()
+	}
+	// the pods on a node are looked up when working out how utilized it is
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, podNodeNameField, indexPodNodeName); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&appv1alpha1.PodSet{}).
 		Owns(&corev1.Pod{}).
+		Owns(&corev1.Service{}).
+		Owns(&appsv1.DaemonSet{}).
+		Owns(&batchv1.Job{}).
+		Watches(&source.Kind{Type: &corev1.Node{}}, handler.EnqueueRequestsFromMapFunc(r.perNodePodSets), builder.WithPredicates(nodeEligibilityChanged)).
 		Complete(r)
 }
 
 // new Pod created for scaling up the PodSet CR
 func (r *PodSetReconciler) newPodForPodSetCustomResource(cr *appv1alpha1.PodSet) *corev1.Pod {
-	labelsForNewPod := map[string]string{
-		"app":     cr.Name,
-		"version": "v0.1",
+	template := podTemplate(cr)
+	return r.newPodFromTemplate(cr, template, templateRevision(template))
+}
+
+// newPodFromTemplate makes a pod of the given revision of the PodSet's template, an older one
+// replaces lost pods while a rollout is held back
+func (r *PodSetReconciler) newPodFromTemplate(cr *appv1alpha1.PodSet, template *corev1.PodTemplateSpec, revision string) *corev1.Pod {
+	// the template's own labels are kept, but can't override the ones the PodSet selects its pods by
+	labelsForNewPod := map[string]string{}
+	for key, value := range template.Labels {
+		labelsForNewPod[key] = value
+	}
+	labelsForNewPod[podSetLabel] = cr.Name
+	labelsForNewPod[podSetUIDLabel] = string(cr.UID)
+	labelsForNewPod[versionLabel] = podVersion(cr)
+	labelsForNewPod[revisionLabel] = revision
+
+	var annotationsForNewPod map[string]string
+	if len(template.Annotations) > 0 {
+		annotationsForNewPod = map[string]string{}
+		for key, value := range template.Annotations {
+			annotationsForNewPod[key] = value
+		}
 	}
 
 	pod := &corev1.Pod{
@@ -170,17 +484,12 @@ func (r *PodSetReconciler) newPodForPodSetCustomResource(cr *appv1alpha1.PodSet)
 			GenerateName: cr.Name + "-pod-",
 			Namespace:    cr.Namespace,
 			Labels:       labelsForNewPod,
+			Annotations:  annotationsForNewPod,
 		},
-		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{
-				{
-					Name:    "busybox",
-					Image:   "busybox",
-					Command: []string{"sleep", "3600"},
-				},
-			},
-		},
+		Spec: *template.Spec.DeepCopy(),
 	}
+	boostPod(cr, pod)
+	addVolumeClaims(cr, pod)
 	ctrl.SetControllerReference(cr, pod, r.Scheme)
 	return pod
 }
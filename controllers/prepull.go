@@ -0,0 +1,260 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+const (
+	// prePullPauseImage keeps the pre-pull pods around once their images are pulled
+	prePullPauseImage = "k8s.gcr.io/pause:3.6"
+	// prePullToolsImage provides the static no-op binary the pullers run, images without a shell,
+	// like distroless or scratch ones, can't run anything of their own
+	prePullToolsImage = "busybox:1.36-musl"
+	// prePullToolsPath is where the no-op binary is mounted into the pullers
+	prePullToolsPath = "/prepull"
+
+	defaultPrePullTimeout = 600 * time.Second
+	prePullPollInterval   = 10 * time.Second
+)
+
+// prePullImages makes sure the images of the given revision are on the eligible nodes before
+// the rollout starts. It returns whether the rollout may go ahead and otherwise how long to
+// wait before checking again. The pre-pull is done by a temporary DaemonSet, which is removed
+// once all of its pods are ready or the timeout passed.
+func (r *PodSetReconciler) prePullImages(ctx context.Context, cr *appv1alpha1.PodSet, revision string, groups []placementGroup, status *appv1alpha1.PodSetStatus) (bool, time.Duration, error) {
+	strategy := cr.Spec.Strategy
+	if strategy == nil || !strategy.PrePull || !features.Enabled(features.ImagePrePull) {
+		return true, 0, r.cleanupPrePull(ctx, cr, "")
+	}
+	if status.PrePull != nil && status.PrePull.Revision == revision && status.PrePull.CompletionTime != nil {
+		return true, 0, r.cleanupPrePull(ctx, cr, "")
+	}
+
+	now := metav1.Now().Rfc3339Copy()
+	if status.PrePull == nil || status.PrePull.Revision != revision {
+		status.PrePull = &appv1alpha1.PrePullStatus{Revision: revision, StartTime: now}
+	}
+
+	// only the DaemonSet of the revision being rolled out is kept around
+	name := fmt.Sprintf("%s-prepull-%s", cr.Name, revision)
+	if err := r.cleanupPrePull(ctx, cr, name); err != nil {
+		return false, 0, err
+	}
+
+	pulled := false
+	daemonSet := &appsv1.DaemonSet{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: name}, daemonSet)
+	switch {
+	case errors.IsNotFound(err):
+		daemonSet = newPrePullDaemonSet(cr, name, revision, groups)
+		if err = controllerutil.SetControllerReference(cr, daemonSet, r.Scheme); err != nil {
+			return false, 0, err
+		}
+		log.Log.Info("Pre-pulling images of PodSet revision", "revision", revision, "daemonset", name)
+		creator, err := r.podCreator(cr)
+		if err != nil {
+			return false, 0, err
+		}
+		if err = creator.Create(ctx, daemonSet); err != nil {
+			return false, 0, err
+		}
+	case err != nil:
+		return false, 0, err
+	default:
+		pulled = daemonSet.Status.ObservedGeneration >= daemonSet.Generation &&
+			daemonSet.Status.NumberReady >= daemonSet.Status.DesiredNumberScheduled
+	}
+
+	timeout := defaultPrePullTimeout
+	if strategy.PrePullTimeoutSeconds != nil {
+		timeout = time.Duration(*strategy.PrePullTimeoutSeconds) * time.Second
+	}
+	elapsed := now.Sub(status.PrePull.StartTime.Time)
+	if !pulled && elapsed < timeout {
+		return false, minRequeue(prePullPollInterval, timeout-elapsed), nil
+	}
+
+	if !pulled {
+		log.Log.Info("Pre-pulling images of PodSet revision timed out, rolling out anyway", "revision", revision)
+	}
+	status.PrePull.CompletionTime = &now
+	status.PrePull.TimedOut = !pulled
+	return true, 0, r.cleanupPrePull(ctx, cr, "")
+}
+
+// cleanupPrePull removes the pre-pull DaemonSets of the PodSet, except for the one named keep
+func (r *PodSetReconciler) cleanupPrePull(ctx context.Context, cr *appv1alpha1.PodSet, keep string) error {
+	daemonSets := &appsv1.DaemonSetList{}
+	if err := r.Client.List(ctx, daemonSets, client.InNamespace(cr.Namespace), client.MatchingLabels{prePullLabel: cr.Name}); err != nil {
+		return err
+	}
+	for i := range daemonSets.Items {
+		daemonSet := &daemonSets.Items[i]
+		if daemonSet.Name == keep || !metav1.IsControlledBy(daemonSet, cr) {
+			continue
+		}
+		if err := r.Client.Delete(ctx, daemonSet, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// newPrePullDaemonSet builds a DaemonSet that runs every image of the revision as a no-op init
+// container on each node the PodSet's pods may be placed on
+func newPrePullDaemonSet(cr *appv1alpha1.PodSet, name, revision string, groups []placementGroup) *appsv1.DaemonSet {
+	template := podTemplate(cr)
+	labels := map[string]string{
+		prePullLabel:  cr.Name,
+		revisionLabel: revision,
+	}
+
+	// the first init container copies a statically linked busybox into a shared volume, run as
+	// "true" it exits right away
+	tools := corev1.VolumeMount{Name: "prepull-tools", MountPath: prePullToolsPath}
+	pullers := []corev1.Container{{
+		Name:         "tools",
+		Image:        prePullToolsImage,
+		Command:      []string{"cp", "/bin/busybox", prePullToolsPath + "/true"},
+		VolumeMounts: []corev1.VolumeMount{tools},
+	}}
+	tools.ReadOnly = true
+	seen := map[string]bool{}
+	containers := append(append([]corev1.Container{}, template.Spec.InitContainers...), template.Spec.Containers...)
+	for _, container := range containers {
+		if seen[container.Image] {
+			continue
+		}
+		seen[container.Image] = true
+		pullers = append(pullers, corev1.Container{
+			Name:            fmt.Sprintf("pull-%d", len(pullers)-1),
+			Image:           container.Image,
+			ImagePullPolicy: container.ImagePullPolicy,
+			Command:         []string{prePullToolsPath + "/true"},
+			VolumeMounts:    []corev1.VolumeMount{tools},
+		})
+	}
+
+	gracePeriod := int64(0)
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					InitContainers:                pullers,
+					Volumes:                       []corev1.Volume{{Name: tools.Name, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}},
+					Containers:                    []corev1.Container{{Name: "pause", Image: prePullPauseImage}},
+					ImagePullSecrets:              template.Spec.ImagePullSecrets,
+					ServiceAccountName:            template.Spec.ServiceAccountName,
+					NodeSelector:                  template.Spec.NodeSelector,
+					Affinity:                      eligibleNodeAffinity(template, groups),
+					Tolerations:                   eligibleTolerations(template, groups),
+					TerminationGracePeriodSeconds: &gracePeriod,
+				},
+			},
+		},
+	}
+}
+
+// eligibleNodeAffinity restricts pods to the nodes any of the placement groups may use, on top of
+// the template's own required node affinity
+func eligibleNodeAffinity(template *corev1.PodTemplateSpec, groups []placementGroup) *corev1.Affinity {
+	var templateTerms []corev1.NodeSelectorTerm
+	if affinity := template.Spec.Affinity; affinity != nil && affinity.NodeAffinity != nil &&
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		templateTerms = affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	}
+
+	var groupTerms []corev1.NodeSelectorTerm
+	for _, group := range groups {
+		// a group without a selector may use any node, so there is nothing to restrict
+		if len(group.nodeSelector) == 0 {
+			groupTerms = nil
+			break
+		}
+		keys := make([]string, 0, len(group.nodeSelector))
+		for key := range group.nodeSelector {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		term := corev1.NodeSelectorTerm{}
+		for _, key := range keys {
+			term.MatchExpressions = append(term.MatchExpressions, corev1.NodeSelectorRequirement{
+				Key:      key,
+				Operator: corev1.NodeSelectorOpIn,
+				Values:   []string{group.nodeSelector[key]},
+			})
+		}
+		groupTerms = append(groupTerms, term)
+	}
+
+	// terms are ORed, so both lists are combined pairwise to AND them
+	terms := templateTerms
+	if len(groupTerms) > 0 && len(templateTerms) > 0 {
+		terms = nil
+		for _, groupTerm := range groupTerms {
+			for _, templateTerm := range templateTerms {
+				terms = append(terms, corev1.NodeSelectorTerm{
+					MatchExpressions: append(append([]corev1.NodeSelectorRequirement{}, templateTerm.MatchExpressions...), groupTerm.MatchExpressions...),
+					MatchFields:      templateTerm.MatchFields,
+				})
+			}
+		}
+	} else if len(groupTerms) > 0 {
+		terms = groupTerms
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+	return &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: terms},
+		},
+	}
+}
+
+// eligibleTolerations collects the tolerations of the template and of every placement group
+func eligibleTolerations(template *corev1.PodTemplateSpec, groups []placementGroup) []corev1.Toleration {
+	tolerations := append([]corev1.Toleration{}, template.Spec.Tolerations...)
+	for _, group := range groups {
+		tolerations = append(tolerations, group.tolerations...)
+	}
+	return tolerations
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+const defaultQuarantineTTL = 24 * time.Hour
+
+// quarantinePods takes the pods annotated for quarantine out of the PodSet. Their labels are
+// swapped for the quarantine label, so Services stop sending them traffic and the PodSet no
+// longer counts them and creates replacements. The pods themselves keep running for inspection.
+// The pods that aren't quarantined are returned.
+func (r *PodSetReconciler) quarantinePods(ctx context.Context, cr *appv1alpha1.PodSet, pods []corev1.Pod, now time.Time) ([]corev1.Pod, error) {
+	if !features.Enabled(features.Quarantine) {
+		return pods, nil
+	}
+	var kept []corev1.Pod
+	for i := range pods {
+		pod := &pods[i]
+		if _, ok := pod.Annotations[quarantineAnnotation]; !ok || pod.DeletionTimestamp != nil {
+			kept = append(kept, *pod)
+			continue
+		}
+
+		previous, err := json.Marshal(pod.Labels)
+		if err != nil {
+			return nil, err
+		}
+		patch := client.MergeFrom(pod.DeepCopy())
+		// not even the PodSet's name is kept, Services commonly select on it
+		pod.Labels = map[string]string{quarantinedLabel: string(cr.UID)}
+		pod.Annotations[quarantinedAtAnnotation] = now.UTC().Format(time.RFC3339)
+		pod.Annotations[quarantinedLabelsAnnotation] = string(previous)
+		log.Log.Info("quarantining pod", "PodSet", cr.Name, "pod", pod.Name)
+		if err := r.Client.Patch(ctx, pod, patch); err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return kept, nil
+}
+
+// expireQuarantinedPods deletes the quarantined pods whose time is up and records the
+// others in the status. The returned duration is when the next one expires.
+func (r *PodSetReconciler) expireQuarantinedPods(ctx context.Context, cr *appv1alpha1.PodSet, status *appv1alpha1.PodSetStatus, now time.Time) (time.Duration, error) {
+	podList := &corev1.PodList{}
+	if err := r.Client.List(ctx, podList, client.InNamespace(cr.Namespace), client.MatchingLabels{quarantinedLabel: string(cr.UID)}); err != nil {
+		return 0, err
+	}
+
+	ttl := defaultQuarantineTTL
+	if cr.Spec.QuarantineTTLSeconds != nil {
+		ttl = time.Duration(*cr.Spec.QuarantineTTLSeconds) * time.Second
+	}
+	var requeueAfter time.Duration
+	status.QuarantinedPods = nil
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		expiresAt := quarantineExpiry(pod, ttl)
+		if wait := expiresAt.Sub(now); wait > 0 {
+			requeueAfter = minRequeue(requeueAfter, wait)
+			status.QuarantinedPods = append(status.QuarantinedPods, appv1alpha1.QuarantinedPod{PodName: pod.Name, ExpiresAt: metav1.NewTime(expiresAt).Rfc3339Copy()})
+			continue
+		}
+		log.Log.Info("deleting quarantined pod", "PodSet", cr.Name, "pod", pod.Name)
+		if err := r.Client.Delete(ctx, pod); err != nil && !errors.IsNotFound(err) {
+			return 0, err
+		}
+	}
+	sort.Slice(status.QuarantinedPods, func(i, j int) bool {
+		return status.QuarantinedPods[i].PodName < status.QuarantinedPods[j].PodName
+	})
+	return requeueAfter, nil
+}
+
+// quarantineExpiry is when a quarantined pod gets deleted: the time in its quarantine
+// annotation if there is one, otherwise the TTL after it was quarantined
+func quarantineExpiry(pod *corev1.Pod, ttl time.Duration) time.Time {
+	if until, err := time.Parse(time.RFC3339, pod.Annotations[quarantineAnnotation]); err == nil {
+		return until
+	}
+	since, err := time.Parse(time.RFC3339, pod.Annotations[quarantinedAtAnnotation])
+	if err != nil {
+		since = pod.CreationTimestamp.Time
+	}
+	return since.Add(ttl)
+}
@@ -0,0 +1,460 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+const (
+	defaultRebalanceInterval = time.Minute
+	// defaultRebalanceMinInterval is the least time between two moves of a PodSet's pods
+	defaultRebalanceMinInterval = 300 * time.Second
+	// rebalanceTimeout is how long a replacement may take to get ready before the move is given up
+	rebalanceTimeout = 10 * time.Minute
+)
+
+// TopologyRebalancer periodically looks for PodSets whose pods are spread unevenly across
+// zones or nodes and marks one pod at a time to be moved to the least populated domain.
+// The PodSet controller carries out the move, surge first: the marked pod is only deleted
+// once its replacement is ready.
+type TopologyRebalancer struct {
+	client.Client
+	Recorder record.EventRecorder
+
+	// Interval between two checks, defaults to a minute
+	Interval time.Duration
+}
+
+// Start checks every Interval until the context is done
+func (b *TopologyRebalancer) Start(ctx context.Context) error {
+	interval := b.Interval
+	if interval <= 0 {
+		interval = defaultRebalanceInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := b.rebalanceAll(ctx, time.Now()); err != nil {
+				log.Log.Error(err, "Failed to rebalance PodSets")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection makes only the leader rebalance, so two pods aren't moved at once
+func (b *TopologyRebalancer) NeedLeaderElection() bool {
+	return true
+}
+
+func (b *TopologyRebalancer) rebalanceAll(ctx context.Context, now time.Time) error {
+	podSets := &appv1alpha1.PodSetList{}
+	if err := b.List(ctx, podSets); err != nil {
+		return err
+	}
+	nodes := &corev1.NodeList{}
+	if err := b.List(ctx, nodes); err != nil {
+		return err
+	}
+	for i := range podSets.Items {
+		cr := &podSets.Items[i]
+		// a PerNode PodSet is spread evenly by definition
+		if cr.Spec.Rebalance == nil || cr.DeletionTimestamp != nil || isPerNode(cr) {
+			continue
+		}
+		if err := b.rebalance(ctx, cr, nodes.Items, now); err != nil {
+			log.Log.Error(err, "Failed to rebalance PodSet", "namespace", cr.Namespace, "podset", cr.Name)
+		}
+	}
+	return nil
+}
+
+// rebalance marks a pod of the PodSet for moving if its pods are skewed beyond MaxSkew. Only a
+// settled PodSet is touched: all of its pods are scheduled, ready and of the current revision,
+// and none is being moved already.
+func (b *TopologyRebalancer) rebalance(ctx context.Context, cr *appv1alpha1.PodSet, nodes []corev1.Node, now time.Time) error {
+	spec := cr.Spec.Rebalance
+	if !inMaintenanceWindow(spec.MaintenanceWindows, now) {
+		return nil
+	}
+	minInterval := defaultRebalanceMinInterval
+	if spec.MinIntervalSeconds != nil {
+		minInterval = time.Duration(*spec.MinIntervalSeconds) * time.Second
+	}
+	// the time of the last move is kept on the PodSet, so it holds across leaders
+	if last, err := time.Parse(time.RFC3339, cr.Annotations[rebalanceLastMoveAnnotation]); err == nil && now.Sub(last) < minInterval {
+		return nil
+	}
+	if _, pending := cr.Annotations[rebalancePendingAnnotation]; pending {
+		return nil
+	}
+
+	podList := &corev1.PodList{}
+	if err := b.List(ctx, podList, client.InNamespace(cr.Namespace), client.MatchingLabels{podSetUIDLabel: string(cr.UID)}); err != nil {
+		return err
+	}
+	var pods []corev1.Pod
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if pod.DeletionTimestamp != nil || isPodTerminal(pod) {
+			continue
+		}
+		if _, moving := pod.Annotations[rebalanceToAnnotation]; moving || !isPodScheduled(pod) || !isPodReady(pod) {
+			return nil
+		}
+		pods = append(pods, *pod)
+	}
+	if len(pods) == 0 || cr.Status.UpdatedReplicas != int32(len(pods)) {
+		return nil
+	}
+
+	// the domains pods can be moved to are the ones with a node the PodSet's pods may run on,
+	// nodes without a zone are left out when spreading across zones
+	template := &corev1.Pod{Spec: podTemplate(cr).Spec}
+	nodeByName := map[string]*corev1.Node{}
+	counts := map[string]int32{}
+	eligible := map[string]bool{}
+	for i := range nodes {
+		node := &nodes[i]
+		domain := topologyDomain(spec.Topology, node)
+		if domain == unknownZone && spec.Topology != appv1alpha1.NodeTopology {
+			continue
+		}
+		nodeByName[node.Name] = node
+		if !node.Spec.Unschedulable && isNodeReady(node) && (&nodeCapacity{node: node}).accepts(template) {
+			eligible[domain] = true
+			counts[domain] = 0
+		}
+	}
+	podsByDomain := map[string][]corev1.Pod{}
+	for _, pod := range pods {
+		node, ok := nodeByName[pod.Spec.NodeName]
+		if !ok {
+			continue
+		}
+		domain := topologyDomain(spec.Topology, node)
+		counts[domain]++
+		podsByDomain[domain] = append(podsByDomain[domain], pod)
+	}
+
+	// move a pod from the most to the least populated domain, by name on a tie
+	var domains []string
+	for domain := range counts {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	source, target := "", ""
+	for _, domain := range domains {
+		if source == "" || counts[domain] > counts[source] {
+			source = domain
+		}
+		if eligible[domain] && (target == "" || counts[domain] < counts[target]) {
+			target = domain
+		}
+	}
+	if target == "" || counts[source]-counts[target] <= spec.MaxSkew {
+		return nil
+	}
+
+	candidates := podsByDomain[source]
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+	pod := &candidates[0]
+
+	// the move is recorded first, against the PodSet as read: a stale copy fails the patch
+	// instead of marking a second pod
+	podSetPatch := client.MergeFromWithOptions(cr.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	if cr.Annotations == nil {
+		cr.Annotations = map[string]string{}
+	}
+	cr.Annotations[rebalanceLastMoveAnnotation] = now.UTC().Format(time.RFC3339)
+	if err := b.Patch(ctx, cr, podSetPatch); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	patch := client.MergeFrom(pod.DeepCopy())
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[rebalanceToAnnotation] = string(spec.Topology) + "/" + target
+	if err := b.Patch(ctx, pod, patch); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	log.Log.Info("Rebalancing PodSet", "namespace", cr.Namespace, "podset", cr.Name, "pod", pod.Name, "from", source, "to", target)
+	b.Recorder.Eventf(cr, corev1.EventTypeNormal, "Rebalancing", "Moving pod %s from %s %s (%d pods) to %s (%d pods)",
+		pod.Name, strings.ToLower(string(spec.Topology)), source, counts[source], target, counts[target])
+	return nil
+}
+
+// topologyDomain is the zone or the name of the node, depending on the topology
+func topologyDomain(topology appv1alpha1.RebalanceTopology, node *corev1.Node) string {
+	if topology == appv1alpha1.NodeTopology {
+		return node.Name
+	}
+	return nodeZone(node)
+}
+
+// inMaintenanceWindow tells whether one of the windows is open at the given time,
+// no windows means always
+func inMaintenanceWindow(windows []appv1alpha1.MaintenanceWindow, now time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	now = now.UTC()
+	for _, window := range windows {
+		start, err := time.Parse("15:04", window.Start)
+		if err != nil {
+			continue
+		}
+		duration, err := time.ParseDuration(window.Duration)
+		if err != nil {
+			continue
+		}
+		// a window that opened on an earlier day, e.g. last night, may still be open
+		for daysAgo := 0; daysAgo <= int(duration/(24*time.Hour))+1; daysAgo++ {
+			day := now.AddDate(0, 0, -daysAgo)
+			opens := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), 0, 0, time.UTC)
+			if !opensOn(window.Days, opens.Weekday()) {
+				continue
+			}
+			if !now.Before(opens) && now.Before(opens.Add(duration)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// opensOn tells whether a window with the given days opens on the weekday
+func opensOn(days []appv1alpha1.Weekday, weekday time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, day := range days {
+		if string(day) == weekday.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// syncRebalanceMoves carries out the moves the rebalancer marked pods for. A replacement is
+// created in the target domain, and the marked pod is deleted once the replacement is ready;
+// a replacement that doesn't get ready in time is deleted instead. The marked pods are left out
+// of the returned pods, their replacements take their place. A non-zero duration asks for the
+// moves to be checked again after that long.
+func (r *PodSetReconciler) syncRebalanceMoves(ctx context.Context, cr *appv1alpha1.PodSet, pods []corev1.Pod, groups []placementGroup, now time.Time) ([]corev1.Pod, time.Duration, error) {
+	replacements := map[string]*corev1.Pod{}
+	marked := map[string]bool{}
+	for i := range pods {
+		if victim, ok := pods[i].Annotations[rebalanceReplacesAnnotation]; ok {
+			replacements[victim] = &pods[i]
+		}
+		if _, ok := pods[i].Annotations[rebalanceToAnnotation]; ok {
+			marked[pods[i].Name] = true
+		}
+	}
+	// a move whose marked pod is gone is over
+	if victim, _, ok := pendingMove(cr); ok && !marked[victim] {
+		if err := r.setPendingMove(ctx, cr, ""); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var remaining []corev1.Pod
+	var requeueAfter time.Duration
+	for i := range pods {
+		pod := &pods[i]
+		target, moving := pod.Annotations[rebalanceToAnnotation]
+		if !moving {
+			remaining = append(remaining, *pod)
+			continue
+		}
+
+		replacement, ok := replacements[pod.Name]
+		if !ok {
+			created, err := r.createReplacement(ctx, cr, pod, target, groups)
+			if err != nil {
+				return nil, 0, err
+			}
+			if created == nil {
+				// the target can't be expressed, the pod stays where it is
+				remaining = append(remaining, *pod)
+				continue
+			}
+			remaining = append(remaining, *created)
+			requeueAfter = minRequeue(requeueAfter, rebalanceTimeout)
+			continue
+		}
+
+		if isPodReady(replacement) {
+			log.Log.Info("Deleting rebalanced pod", "namespace", cr.Namespace, "pod", pod.Name, "replacement", replacement.Name)
+			if err := r.Client.Delete(ctx, pod); err != nil && !errors.IsNotFound(err) {
+				return nil, 0, err
+			}
+			continue
+		}
+		if waited := now.Sub(replacement.CreationTimestamp.Time); waited < rebalanceTimeout {
+			requeueAfter = minRequeue(requeueAfter, rebalanceTimeout-waited)
+			continue
+		}
+
+		// the replacement didn't get ready, the pod stays where it is
+		r.Recorder.Eventf(cr, corev1.EventTypeWarning, "RebalanceAbandoned", "Replacement %s of pod %s did not get ready in %s", replacement.Name, pod.Name, rebalanceTimeout)
+		if err := r.Client.Delete(ctx, replacement); err != nil && !errors.IsNotFound(err) {
+			return nil, 0, err
+		}
+		patch := client.MergeFrom(pod.DeepCopy())
+		delete(pod.Annotations, rebalanceToAnnotation)
+		if err := r.Client.Patch(ctx, pod, patch); err != nil && !errors.IsNotFound(err) {
+			return nil, 0, err
+		}
+		remaining = append(remaining, *pod)
+	}
+	return remaining, requeueAfter, nil
+}
+
+// pendingMove returns the marked pod and the name of its replacement recorded on the PodSet
+func pendingMove(cr *appv1alpha1.PodSet) (string, string, bool) {
+	parts := strings.SplitN(cr.Annotations[rebalancePendingAnnotation], "/", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// setPendingMove records the move being carried out on the PodSet, or clears it when empty.
+// The patch fails if the PodSet changed since it was read, so a stale copy of the PodSet can't
+// start a move twice.
+func (r *PodSetReconciler) setPendingMove(ctx context.Context, cr *appv1alpha1.PodSet, move string) error {
+	patch := client.MergeFromWithOptions(cr.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	if move == "" {
+		delete(cr.Annotations, rebalancePendingAnnotation)
+	} else {
+		if cr.Annotations == nil {
+			cr.Annotations = map[string]string{}
+		}
+		cr.Annotations[rebalancePendingAnnotation] = move
+	}
+	return r.Client.Patch(ctx, cr, patch)
+}
+
+// createReplacement creates the pod replacing a marked pod, pinned to the target domain.
+// It returns nil if the target isn't a domain the pod can be pinned to. The name of the
+// replacement is recorded on the PodSet before it is created, a replacement that was created
+// but isn't in the cache yet is then found by its name instead of being created again.
+func (r *PodSetReconciler) createReplacement(ctx context.Context, cr *appv1alpha1.PodSet, pod *corev1.Pod, target string, groups []placementGroup) (*corev1.Pod, error) {
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	var term corev1.NodeSelectorTerm
+	switch appv1alpha1.RebalanceTopology(parts[0]) {
+	case appv1alpha1.ZoneTopology:
+		term.MatchExpressions = []corev1.NodeSelectorRequirement{{Key: corev1.LabelTopologyZone, Operator: corev1.NodeSelectorOpIn, Values: []string{parts[1]}}}
+	case appv1alpha1.NodeTopology:
+		term.MatchFields = []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{parts[1]}}}
+	default:
+		return nil, nil
+	}
+
+	replacement := r.newPodForPodSetCustomResource(cr)
+	for i := range groups {
+		if groups[i].name == pod.Labels[placementLabel] {
+			groups[i].applyTo(replacement)
+		}
+	}
+	requireNodes(replacement, term)
+	if replacement.Annotations == nil {
+		replacement.Annotations = map[string]string{}
+	}
+	replacement.Annotations[rebalanceReplacesAnnotation] = pod.Name
+	if err := controllerutil.SetControllerReference(cr, replacement, r.Scheme); err != nil {
+		return nil, err
+	}
+
+	if victim, name, ok := pendingMove(cr); ok && victim == pod.Name {
+		replacement.Name = name
+	} else {
+		if replacement.Name == "" {
+			replacement.Name = replacement.GenerateName + rand.String(5)
+		}
+		if err := r.setPendingMove(ctx, cr, pod.Name+"/"+replacement.Name); err != nil {
+			return nil, err
+		}
+	}
+	replacement.GenerateName = ""
+	// the PVCs are named after the pod
+	addVolumeClaims(cr, replacement)
+
+	creator, err := r.podCreator(cr)
+	if err != nil {
+		return nil, err
+	}
+	if err := creator.Create(ctx, replacement); errors.IsAlreadyExists(err) {
+		existing := &corev1.Pod{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Namespace: replacement.Namespace, Name: replacement.Name}, existing); err != nil {
+			return nil, err
+		}
+		return existing, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("creating the replacement of pod %s: %w", pod.Name, err)
+	}
+	log.Log.Info("Created rebalancing replacement", "namespace", cr.Namespace, "pod", pod.Name, "replacement", replacement.Name, "target", target)
+	return replacement, nil
+}
+
+// requireNodes adds a term every node the pod is scheduled to has to match, on top of the
+// node affinity it already has
+func requireNodes(pod *corev1.Pod, term corev1.NodeSelectorTerm) {
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	required := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{term}}
+		return
+	}
+	// the terms are ORed, so the requirement is added to each of them
+	for i := range required.NodeSelectorTerms {
+		required.NodeSelectorTerms[i].MatchExpressions = append(required.NodeSelectorTerms[i].MatchExpressions, term.MatchExpressions...)
+		required.NodeSelectorTerms[i].MatchFields = append(required.NodeSelectorTerms[i].MatchFields, term.MatchFields...)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+func TestInMaintenanceWindow(t *testing.T) {
+	// June 1st 2022 is a Wednesday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2022, time.June, day, hour, minute, 0, 0, time.UTC)
+	}
+	window := func(start, duration string, days ...appv1alpha1.Weekday) appv1alpha1.MaintenanceWindow {
+		return appv1alpha1.MaintenanceWindow{Days: days, Start: start, Duration: duration}
+	}
+	tests := []struct {
+		name    string
+		windows []appv1alpha1.MaintenanceWindow
+		now     time.Time
+		want    bool
+	}{
+		{name: "no windows", now: at(1, 12, 0), want: true},
+		{name: "inside a daily window", windows: []appv1alpha1.MaintenanceWindow{window("02:00", "2h")}, now: at(1, 3, 0), want: true},
+		{name: "at the opening", windows: []appv1alpha1.MaintenanceWindow{window("02:00", "2h")}, now: at(1, 2, 0), want: true},
+		{name: "at the closing", windows: []appv1alpha1.MaintenanceWindow{window("02:00", "2h")}, now: at(1, 4, 0), want: false},
+		{name: "before the opening", windows: []appv1alpha1.MaintenanceWindow{window("02:00", "2h")}, now: at(1, 1, 59), want: false},
+		{name: "on a listed day", windows: []appv1alpha1.MaintenanceWindow{window("02:00", "2h", "Monday", "Wednesday")}, now: at(1, 3, 0), want: true},
+		{name: "on another day", windows: []appv1alpha1.MaintenanceWindow{window("02:00", "2h", "Tuesday")}, now: at(1, 3, 0), want: false},
+		{name: "overnight window still open", windows: []appv1alpha1.MaintenanceWindow{window("22:00", "4h", "Tuesday")}, now: at(1, 1, 0), want: true},
+		{name: "overnight window closed", windows: []appv1alpha1.MaintenanceWindow{window("22:00", "4h", "Tuesday")}, now: at(1, 2, 0), want: false},
+		{name: "overnight window only opens on its days", windows: []appv1alpha1.MaintenanceWindow{window("22:00", "4h", "Wednesday")}, now: at(1, 1, 0), want: false},
+		{name: "window spanning days", windows: []appv1alpha1.MaintenanceWindow{window("20:00", "50h", "Monday")}, now: at(1, 21, 0), want: true},
+		{name: "window spanning days closed", windows: []appv1alpha1.MaintenanceWindow{window("20:00", "50h", "Monday")}, now: at(1, 22, 0), want: false},
+		{name: "minutes", windows: []appv1alpha1.MaintenanceWindow{window("12:00", "30m")}, now: at(1, 12, 29), want: true},
+		{name: "any window open", windows: []appv1alpha1.MaintenanceWindow{window("02:00", "1h"), window("12:00", "1h")}, now: at(1, 12, 30), want: true},
+		{name: "invalid windows never open", windows: []appv1alpha1.MaintenanceWindow{window("2am", "1h"), window("12:00", "1d")}, now: at(1, 12, 30), want: false},
+		{name: "times are UTC", windows: []appv1alpha1.MaintenanceWindow{window("02:00", "1h")}, now: at(1, 2, 30).In(time.FixedZone("UTC+5", 5*60*60)), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inMaintenanceWindow(tt.windows, tt.now); got != tt.want {
+				t.Errorf("inMaintenanceWindow at %s = %v, want %v", tt.now, got, tt.want)
+			}
+		})
+	}
+}
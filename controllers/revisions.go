@@ -0,0 +1,227 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+// defaultPodTemplate is what PodSets without a template run
+func defaultPodTemplate() *corev1.PodTemplateSpec {
+	return &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "busybox",
+					Image:   "busybox",
+					Command: []string{"sleep", "3600"},
+				},
+			},
+		},
+	}
+}
+
+// podTemplate returns the template the PodSet's pods are created from
+func podTemplate(cr *appv1alpha1.PodSet) *corev1.PodTemplateSpec {
+	if cr.Spec.Template != nil {
+		return cr.Spec.Template
+	}
+	return defaultPodTemplate()
+}
+
+// templateRevision hashes the pod template into a short name that is safe to use as a label value
+func templateRevision(template *corev1.PodTemplateSpec) string {
+	data, err := json.Marshal(template)
+	if err != nil {
+		// a template that can't be marshalled wouldn't have made it through the API server
+		panic(fmt.Sprintf("failed to marshal pod template: %v", err))
+	}
+	hasher := fnv.New32a()
+	hasher.Write(data)
+	return rand.SafeEncodeString(fmt.Sprint(hasher.Sum32()))
+}
+
+// isCurrentRevision tells whether the pod was created from the given revision. Pods from
+// before revisions were tracked carry no revision label, they ran the default template.
+func isCurrentRevision(cr *appv1alpha1.PodSet, pod *corev1.Pod, revision string) bool {
+	podRevision, ok := pod.Labels[revisionLabel]
+	if !ok {
+		return cr.Spec.Template == nil
+	}
+	return podRevision == revision
+}
+
+// splitByRevision separates the pods running the given revision from the outdated ones
+func splitByRevision(cr *appv1alpha1.PodSet, pods []corev1.Pod, revision string) (updated, outdated []corev1.Pod) {
+	for _, pod := range pods {
+		if isCurrentRevision(cr, &pod, revision) {
+			updated = append(updated, pod)
+		} else {
+			outdated = append(outdated, pod)
+		}
+	}
+	return updated, outdated
+}
+
+// defaultRevisionHistoryLimit is the number of revisions kept unless the PodSet says otherwise
+const defaultRevisionHistoryLimit = 10
+
+// syncRevisionHistory records the template as a ControllerRevision of the PodSet and returns its
+// sequence number. Going back to an older template reuses its ControllerRevision, which is moved
+// to the head of the history. The oldest revisions beyond the history limit are removed.
+func (r *PodSetReconciler) syncRevisionHistory(ctx context.Context, cr *appv1alpha1.PodSet, template *corev1.PodTemplateSpec, revision string) (int64, error) {
+	history := &appsv1.ControllerRevisionList{}
+	if err := r.Client.List(ctx, history, client.InNamespace(cr.Namespace), client.MatchingLabels{podSetLabel: cr.Name}); err != nil {
+		return 0, err
+	}
+	var revisions []*appsv1.ControllerRevision
+	var current *appsv1.ControllerRevision
+	var latest int64
+	for i := range history.Items {
+		if !metav1.IsControlledBy(&history.Items[i], cr) {
+			continue
+		}
+		revisions = append(revisions, &history.Items[i])
+		if history.Items[i].Labels[revisionLabel] == revision {
+			current = &history.Items[i]
+		}
+		if history.Items[i].Revision > latest {
+			latest = history.Items[i].Revision
+		}
+	}
+
+	changeCause := cr.Annotations[appv1alpha1.ChangeCauseAnnotation]
+	switch {
+	case current == nil:
+		data, err := json.Marshal(template)
+		if err != nil {
+			return 0, err
+		}
+		current = &appsv1.ControllerRevision{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-%s", cr.Name, revision),
+				Namespace: cr.Namespace,
+				Labels: map[string]string{
+					podSetLabel:   cr.Name,
+					revisionLabel: revision,
+				},
+			},
+			Data:     runtime.RawExtension{Raw: data},
+			Revision: latest + 1,
+		}
+		if changeCause != "" {
+			current.Annotations = map[string]string{appv1alpha1.ChangeCauseAnnotation: changeCause}
+		}
+		if err = controllerutil.SetControllerReference(cr, current, r.Scheme); err != nil {
+			return 0, err
+		}
+		log.Log.Info("Recording new revision of PodSet", "revision", revision, "number", current.Revision)
+		if err = r.Client.Create(ctx, current); err != nil {
+			return 0, err
+		}
+		revisions = append(revisions, current)
+	case current.Revision != latest || (changeCause != "" && current.Annotations[appv1alpha1.ChangeCauseAnnotation] != changeCause):
+		if current.Revision != latest {
+			current.Revision = latest + 1
+		}
+		if changeCause != "" {
+			if current.Annotations == nil {
+				current.Annotations = map[string]string{}
+			}
+			current.Annotations[appv1alpha1.ChangeCauseAnnotation] = changeCause
+		}
+		if err := r.Client.Update(ctx, current); err != nil {
+			return 0, err
+		}
+	}
+
+	limit := defaultRevisionHistoryLimit
+	if cr.Spec.RevisionHistoryLimit != nil {
+		limit = int(*cr.Spec.RevisionHistoryLimit)
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision < revisions[j].Revision
+	})
+	for i := 0; i < len(revisions)-limit; i++ {
+		if revisions[i] == current {
+			continue
+		}
+		if err := r.Client.Delete(ctx, revisions[i]); err != nil && !errors.IsNotFound(err) {
+			return 0, err
+		}
+	}
+	return current.Revision, nil
+}
+
+// rolledOutTemplate returns the template and revision of the newest revision the outdated pods
+// run, lost pods are replaced from it while the rollout of the current revision is held back.
+// Pods without a revision label ran the default template. A nil template is returned when the
+// revision is no longer in the history.
+func (r *PodSetReconciler) rolledOutTemplate(ctx context.Context, cr *appv1alpha1.PodSet, outdatedPods []corev1.Pod) (*corev1.PodTemplateSpec, string, error) {
+	running := map[string]bool{}
+	unlabelled := false
+	for i := range outdatedPods {
+		if revision, ok := outdatedPods[i].Labels[revisionLabel]; ok {
+			running[revision] = true
+		} else {
+			unlabelled = true
+		}
+	}
+
+	history := &appsv1.ControllerRevisionList{}
+	if err := r.Client.List(ctx, history, client.InNamespace(cr.Namespace), client.MatchingLabels{podSetLabel: cr.Name}); err != nil {
+		return nil, "", err
+	}
+	var newest *appsv1.ControllerRevision
+	for i := range history.Items {
+		item := &history.Items[i]
+		if !metav1.IsControlledBy(item, cr) || !running[item.Labels[revisionLabel]] {
+			continue
+		}
+		if newest == nil || item.Revision > newest.Revision {
+			newest = item
+		}
+	}
+	if newest == nil {
+		if unlabelled {
+			template := defaultPodTemplate()
+			return template, templateRevision(template), nil
+		}
+		return nil, "", nil
+	}
+	template := &corev1.PodTemplateSpec{}
+	if err := json.Unmarshal(newest.Data.Raw, template); err != nil {
+		return nil, "", err
+	}
+	return template, newest.Labels[revisionLabel], nil
+}
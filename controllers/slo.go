@@ -0,0 +1,203 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+const (
+	// sloSampleInterval is how often availability is sampled while nothing changes
+	sloSampleInterval = 5 * time.Minute
+	// sloBuckets is the number of rollups the SLO window is split into
+	sloBuckets = 30
+)
+
+// sampleSLO integrates the last sample of ready and desired pods up to now into the rollups
+// of the SLO window and takes a new one, then works out availability and error budget.
+// Samples are only taken when the pod counts changed or the sample interval has passed,
+// so that the status doesn't change on every reconcile. The returned duration is when the
+// next sample is due. An SLO that can't be parsed leaves the samples alone and is reported
+// in the ErrorBudgetExhausted condition.
+func sampleSLO(cr *appv1alpha1.PodSet, ready, desired int32, status *appv1alpha1.PodSetStatus, now time.Time) time.Duration {
+	slo := cr.Spec.SLO
+	if slo == nil || !features.Enabled(features.AvailabilitySLO) {
+		status.SLO = nil
+		meta.RemoveStatusCondition(&status.Conditions, appv1alpha1.ConditionErrorBudgetExhausted)
+		return 0
+	}
+	window, target, err := parseSLO(slo)
+	if err != nil {
+		status.SLO = cr.Status.SLO
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               appv1alpha1.ConditionErrorBudgetExhausted,
+			Status:             metav1.ConditionUnknown,
+			ObservedGeneration: cr.Generation,
+			Reason:             "InvalidSLO",
+			Message:            err.Error(),
+		})
+		return 0
+	}
+
+	sample := &appv1alpha1.SLOStatus{}
+	if cr.Status.SLO != nil {
+		sample = cr.Status.SLO.DeepCopy()
+	}
+	if last := sample.LastSampleTime; last != nil {
+		elapsed := now.Sub(last.Time)
+		if elapsed < sloSampleInterval && sample.LastReadyReplicas == ready && sample.LastDesiredReplicas == desired {
+			status.SLO = sample
+			return sloSampleInterval - elapsed
+		}
+		from := last.Time
+		// whatever happened before the window can't count anymore
+		if from.Before(now.Add(-window)) {
+			from = now.Add(-window)
+		}
+		addSLOSample(sample, from, now, window/sloBuckets)
+	}
+	sampledAt := metav1.NewTime(now).Rfc3339Copy()
+	sample.LastSampleTime = &sampledAt
+	sample.LastReadyReplicas = ready
+	sample.LastDesiredReplicas = desired
+
+	// rollups that fell out of the window are dropped
+	start := now.Add(-window)
+	kept := sample.Buckets[:0]
+	for _, bucket := range sample.Buckets {
+		if bucket.Start.Add(window / sloBuckets).After(start) {
+			kept = append(kept, bucket)
+		}
+	}
+	sample.Buckets = kept
+
+	var desiredSeconds, readySeconds int64
+	for _, bucket := range sample.Buckets {
+		desiredSeconds += bucket.DesiredReplicaSeconds
+		readySeconds += bucket.ReadyReplicaSeconds
+	}
+	sample.Availability = ""
+	sample.ErrorBudgetRemaining = ""
+	exhausted := false
+	if desiredSeconds > 0 {
+		availability := 100 * float64(readySeconds) / float64(desiredSeconds)
+		budget := 100 - target
+		remaining := -100.0
+		if budget > 0 {
+			remaining = 100 * (budget - (100 - availability)) / budget
+		} else if availability >= 100 {
+			remaining = 0
+		}
+		exhausted = remaining <= 0 && availability < 100
+		sample.Availability = strconv.FormatFloat(availability, 'f', 3, 64)
+		sample.ErrorBudgetRemaining = strconv.FormatFloat(remaining, 'f', 1, 64)
+	}
+	status.SLO = sample
+
+	condition := metav1.Condition{
+		Type:               appv1alpha1.ConditionErrorBudgetExhausted,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: cr.Generation,
+		Reason:             "WithinBudget",
+		Message:            fmt.Sprintf("availability is within the %s%% objective", slo.Target),
+	}
+	if exhausted {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "BudgetExhausted"
+		condition.Message = fmt.Sprintf("availability of %s%% over %s is below the %s%% objective", sample.Availability, slo.Window, slo.Target)
+	}
+	meta.SetStatusCondition(&status.Conditions, condition)
+	return sloSampleInterval
+}
+
+// addSLOSample adds the last sample, which held from one time to another, to the rollups,
+// split along the bucket boundaries
+func addSLOSample(sample *appv1alpha1.SLOStatus, from, to time.Time, bucketSize time.Duration) {
+	desired := int64(sample.LastDesiredReplicas)
+	ready := int64(sample.LastReadyReplicas)
+	if ready > desired {
+		ready = desired
+	}
+	// nothing is owed while the PodSet is scaled to zero
+	if desired == 0 {
+		return
+	}
+	for from.Before(to) {
+		start := from.Truncate(bucketSize)
+		end := start.Add(bucketSize)
+		if end.After(to) {
+			end = to
+		}
+		seconds := int64(end.Sub(from) / time.Second)
+		if len(sample.Buckets) == 0 || !sample.Buckets[len(sample.Buckets)-1].Start.Time.Equal(start) {
+			sample.Buckets = append(sample.Buckets, appv1alpha1.SLOBucket{Start: metav1.NewTime(start).Rfc3339Copy()})
+		}
+		bucket := &sample.Buckets[len(sample.Buckets)-1]
+		bucket.DesiredReplicaSeconds += desired * seconds
+		bucket.ReadyReplicaSeconds += ready * seconds
+		from = end
+	}
+}
+
+// errorBudgetExhausted tells whether the PodSet's rollouts are held back by its SLO, which only
+// holds back replacing outdated pods, not scaling or replacing lost pods
+func errorBudgetExhausted(cr *appv1alpha1.PodSet, status *appv1alpha1.PodSetStatus) bool {
+	return cr.Spec.SLO != nil && cr.Spec.SLO.BlockRollouts &&
+		meta.IsStatusConditionTrue(status.Conditions, appv1alpha1.ConditionErrorBudgetExhausted)
+}
+
+// parseSLO parses the window and the target of the SLO
+func parseSLO(slo *appv1alpha1.SLO) (time.Duration, float64, error) {
+	window, err := parseSLOWindow(slo.Window)
+	if err != nil {
+		return 0, 0, err
+	}
+	target, err := slo.Target.Float64()
+	if err != nil || target < 0 || target > 100 {
+		return 0, 0, fmt.Errorf("invalid SLO target %q, it has to be a percentage from 0 to 100", string(slo.Target))
+	}
+	return window, target, nil
+}
+
+// parseSLOWindow parses a window like 30d, 12h or 90m
+func parseSLOWindow(window string) (time.Duration, error) {
+	var duration time.Duration
+	var err error
+	if days := strings.TrimSuffix(window, "d"); days != window {
+		var n int
+		n, err = strconv.Atoi(days)
+		duration = time.Duration(n) * 24 * time.Hour
+	} else {
+		duration, err = time.ParseDuration(window)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid SLO window %q: %w", window, err)
+	}
+	if duration < time.Minute {
+		return 0, fmt.Errorf("SLO window %q is too short, it has to be at least a minute", window)
+	}
+	return duration, nil
+}
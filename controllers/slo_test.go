@@ -0,0 +1,267 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+func sloBucket(start time.Time, desired, ready int64) appv1alpha1.SLOBucket {
+	return appv1alpha1.SLOBucket{Start: metav1.NewTime(start), DesiredReplicaSeconds: desired, ReadyReplicaSeconds: ready}
+}
+
+func TestAddSLOSample(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2022, time.June, 1, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name           string
+		buckets        []appv1alpha1.SLOBucket
+		desired, ready int32
+		from, to       time.Time
+		want           []appv1alpha1.SLOBucket
+	}{
+		{
+			name:    "within a bucket",
+			desired: 2, ready: 1,
+			from: at(10, 10), to: at(10, 40),
+			want: []appv1alpha1.SLOBucket{sloBucket(at(10, 0), 3600, 1800)},
+		},
+		{
+			name:    "split along bucket boundaries",
+			desired: 1, ready: 1,
+			from: at(10, 30), to: at(12, 15),
+			want: []appv1alpha1.SLOBucket{
+				sloBucket(at(10, 0), 1800, 1800),
+				sloBucket(at(11, 0), 3600, 3600),
+				sloBucket(at(12, 0), 900, 900),
+			},
+		},
+		{
+			name:    "adds to the open bucket",
+			buckets: []appv1alpha1.SLOBucket{sloBucket(at(10, 0), 100, 50)},
+			desired: 1, ready: 0,
+			from: at(10, 50), to: at(11, 10),
+			want: []appv1alpha1.SLOBucket{
+				sloBucket(at(10, 0), 700, 50),
+				sloBucket(at(11, 0), 600, 0),
+			},
+		},
+		{
+			name:    "surplus ready pods don't count",
+			desired: 1, ready: 3,
+			from: at(10, 0), to: at(10, 1),
+			want: []appv1alpha1.SLOBucket{sloBucket(at(10, 0), 60, 60)},
+		},
+		{
+			name:    "nothing is owed at zero replicas",
+			desired: 0, ready: 0,
+			from: at(10, 0), to: at(11, 0),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sample := &appv1alpha1.SLOStatus{Buckets: tt.buckets, LastDesiredReplicas: tt.desired, LastReadyReplicas: tt.ready}
+			addSLOSample(sample, tt.from, tt.to, time.Hour)
+			if len(sample.Buckets) != len(tt.want) {
+				t.Fatalf("got buckets %v, want %v", sample.Buckets, tt.want)
+			}
+			for i := range tt.want {
+				got, want := sample.Buckets[i], tt.want[i]
+				if !got.Start.Equal(&want.Start) || got.DesiredReplicaSeconds != want.DesiredReplicaSeconds || got.ReadyReplicaSeconds != want.ReadyReplicaSeconds {
+					t.Errorf("bucket %d = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSampleSLO(t *testing.T) {
+	if err := features.Gate.SetFromMap(map[string]bool{string(features.AvailabilitySLO): true}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = features.Gate.SetFromMap(map[string]bool{string(features.AvailabilitySLO): false})
+	}()
+
+	now := time.Date(2022, time.June, 1, 12, 30, 0, 0, time.UTC)
+	sampledAt := func(ago time.Duration) *metav1.Time {
+		at := metav1.NewTime(now.Add(-ago))
+		return &at
+	}
+	// a last sample at zero replicas adds nothing, so the buckets alone make up the result
+	fromBuckets := func(buckets ...appv1alpha1.SLOBucket) *appv1alpha1.SLOStatus {
+		return &appv1alpha1.SLOStatus{Buckets: buckets, LastSampleTime: sampledAt(10 * time.Minute)}
+	}
+
+	tests := []struct {
+		name     string
+		target   appv1alpha1.Percentage
+		window   string
+		previous *appv1alpha1.SLOStatus
+
+		wantAvailability string
+		wantRemaining    string
+		// the condition is left as it was when wantCondition is empty
+		wantCondition metav1.ConditionStatus
+		wantReason    string
+		wantRequeue   time.Duration
+	}{
+		{
+			name:          "first sample",
+			wantCondition: metav1.ConditionFalse,
+			wantReason:    "WithinBudget",
+			wantRequeue:   sloSampleInterval,
+		},
+		{
+			name: "unchanged pods aren't sampled again",
+			previous: &appv1alpha1.SLOStatus{
+				Availability: "99.000", ErrorBudgetRemaining: "0.0",
+				LastSampleTime: sampledAt(2 * time.Minute), LastDesiredReplicas: 2, LastReadyReplicas: 2,
+			},
+			wantAvailability: "99.000",
+			wantRemaining:    "0.0",
+			wantRequeue:      3 * time.Minute,
+		},
+		{
+			name:             "last sample is integrated",
+			previous:         &appv1alpha1.SLOStatus{LastSampleTime: sampledAt(10 * time.Minute), LastDesiredReplicas: 2, LastReadyReplicas: 1},
+			wantAvailability: "50.000",
+			wantRemaining:    "-4900.0",
+			wantCondition:    metav1.ConditionTrue,
+			wantReason:       "BudgetExhausted",
+			wantRequeue:      sloSampleInterval,
+		},
+		{
+			name:             "half of the budget spent",
+			previous:         fromBuckets(sloBucket(now.Add(-2*time.Hour), 10000, 9950)),
+			wantAvailability: "99.500",
+			wantRemaining:    "50.0",
+			wantCondition:    metav1.ConditionFalse,
+			wantReason:       "WithinBudget",
+			wantRequeue:      sloSampleInterval,
+		},
+		{
+			name:             "budget overspent",
+			previous:         fromBuckets(sloBucket(now.Add(-2*time.Hour), 10000, 9800)),
+			wantAvailability: "98.000",
+			wantRemaining:    "-100.0",
+			wantCondition:    metav1.ConditionTrue,
+			wantReason:       "BudgetExhausted",
+			wantRequeue:      sloSampleInterval,
+		},
+		{
+			name: "buckets out of the window are dropped",
+			previous: fromBuckets(
+				sloBucket(now.Add(-31*time.Hour), 10000, 0),
+				sloBucket(now.Add(-2*time.Hour), 10000, 10000),
+			),
+			wantAvailability: "100.000",
+			wantRemaining:    "100.0",
+			wantCondition:    metav1.ConditionFalse,
+			wantReason:       "WithinBudget",
+			wantRequeue:      sloSampleInterval,
+		},
+		{
+			name:             "no budget at a 100% target",
+			target:           "100",
+			previous:         fromBuckets(sloBucket(now.Add(-2*time.Hour), 10000, 10000)),
+			wantAvailability: "100.000",
+			wantRemaining:    "0.0",
+			wantCondition:    metav1.ConditionFalse,
+			wantReason:       "WithinBudget",
+			wantRequeue:      sloSampleInterval,
+		},
+		{
+			name:             "any downtime exhausts a 100% target",
+			target:           "100",
+			previous:         fromBuckets(sloBucket(now.Add(-2*time.Hour), 10000, 9999)),
+			wantAvailability: "99.990",
+			wantRemaining:    "-100.0",
+			wantCondition:    metav1.ConditionTrue,
+			wantReason:       "BudgetExhausted",
+			wantRequeue:      sloSampleInterval,
+		},
+		{
+			name:          "target out of range",
+			target:        "101",
+			wantCondition: metav1.ConditionUnknown,
+			wantReason:    "InvalidSLO",
+		},
+		{
+			name:          "window too short",
+			window:        "0m",
+			wantCondition: metav1.ConditionUnknown,
+			wantReason:    "InvalidSLO",
+		},
+		{
+			name:          "window under a minute",
+			window:        "45s",
+			wantCondition: metav1.ConditionUnknown,
+			wantReason:    "InvalidSLO",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slo := &appv1alpha1.SLO{Target: "99", Window: "30h"}
+			if tt.target != "" {
+				slo.Target = tt.target
+			}
+			if tt.window != "" {
+				slo.Window = tt.window
+			}
+			cr := &appv1alpha1.PodSet{Spec: appv1alpha1.PodSetSpec{SLO: slo}}
+			cr.Status.SLO = tt.previous
+
+			status := &appv1alpha1.PodSetStatus{}
+			requeueAfter := sampleSLO(cr, 2, 2, status, now)
+
+			if requeueAfter != tt.wantRequeue {
+				t.Errorf("requeue after %s, want %s", requeueAfter, tt.wantRequeue)
+			}
+			condition := meta.FindStatusCondition(status.Conditions, appv1alpha1.ConditionErrorBudgetExhausted)
+			if tt.wantCondition == "" {
+				if condition != nil {
+					t.Errorf("condition = %v, want it left alone", condition)
+				}
+			} else if condition == nil || condition.Status != tt.wantCondition || condition.Reason != tt.wantReason {
+				t.Fatalf("condition = %v, want %s with reason %s", condition, tt.wantCondition, tt.wantReason)
+			}
+			if tt.wantReason == "InvalidSLO" {
+				if !reflect.DeepEqual(status.SLO, tt.previous) {
+					t.Errorf("an invalid SLO changed the samples to %v", status.SLO)
+				}
+				return
+			}
+			if status.SLO.Availability != tt.wantAvailability || status.SLO.ErrorBudgetRemaining != tt.wantRemaining {
+				t.Errorf("availability %q with %q of the budget left, want %q with %q",
+					status.SLO.Availability, status.SLO.ErrorBudgetRemaining, tt.wantAvailability, tt.wantRemaining)
+			}
+			if tt.wantRequeue == sloSampleInterval && !status.SLO.LastSampleTime.Time.Equal(now) {
+				t.Errorf("last sample taken at %s, want %s", status.SLO.LastSampleTime, now)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+//+kubebuilder:rbac:groups="",resources=pods/resize,verbs=patch
+
+// boostPod adds the PodSet's startup boost to the containers of a new pod that have a CPU
+// request, keeping the CPU resources they go back to in an annotation
+func boostPod(cr *appv1alpha1.PodSet, pod *corev1.Pod) {
+	boost := cr.Spec.StartupBoost
+	if boost == nil || boost.CPU.IsZero() || !features.Enabled(features.StartupBoost) {
+		return
+	}
+	original := map[string]corev1.ResourceRequirements{}
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		request, ok := container.Resources.Requests[corev1.ResourceCPU]
+		if !ok {
+			continue
+		}
+		resources := corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: request.DeepCopy()}}
+		request.Add(boost.CPU)
+		container.Resources.Requests[corev1.ResourceCPU] = request
+		if limit, ok := container.Resources.Limits[corev1.ResourceCPU]; ok {
+			resources.Limits = corev1.ResourceList{corev1.ResourceCPU: limit.DeepCopy()}
+			limit.Add(boost.CPU)
+			container.Resources.Limits[corev1.ResourceCPU] = limit
+		}
+		original[container.Name] = resources
+	}
+	if len(original) == 0 {
+		return
+	}
+	data, err := json.Marshal(original)
+	if err != nil {
+		return
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[startupBoostAnnotation] = string(data)
+}
+
+// endStartupBoosts takes the startup boost away from the pods that are ready, or have been running
+// for the boost's duration, by resizing them in place. Pods the cluster can't resize keep their
+// boost. A non-zero duration asks for the pods to be checked again after that long.
+func (r *PodSetReconciler) endStartupBoosts(ctx context.Context, cr *appv1alpha1.PodSet, pods []corev1.Pod, now time.Time) (time.Duration, error) {
+	var requeueAfter time.Duration
+	for i := range pods {
+		pod := &pods[i]
+		data, ok := pod.Annotations[startupBoostAnnotation]
+		if !ok || pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		// the duration is taken from the PodSet, as it is now, and from when the kubelet started the pod
+		if boost := cr.Spec.StartupBoost; boost != nil && boost.DurationSeconds != nil {
+			started := pod.CreationTimestamp.Time
+			if pod.Status.StartTime != nil {
+				started = pod.Status.StartTime.Time
+			}
+			if wait := started.Add(time.Duration(*boost.DurationSeconds) * time.Second).Sub(now); wait > 0 {
+				requeueAfter = minRequeue(requeueAfter, wait)
+				continue
+			}
+		} else if !isPodReady(pod) {
+			continue
+		}
+
+		original := map[string]corev1.ResourceRequirements{}
+		if err := json.Unmarshal([]byte(data), &original); err != nil {
+			log.Log.Error(err, "Dropping an unreadable startup boost annotation", "pod", pod.Name)
+			if err := r.dropStartupBoost(ctx, pod); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		var containers []map[string]interface{}
+		for name, resources := range original {
+			containers = append(containers, map[string]interface{}{"name": name, "resources": resources})
+		}
+		patch, err := json.Marshal(map[string]interface{}{"spec": map[string]interface{}{"containers": containers}})
+		if err != nil {
+			return 0, err
+		}
+
+		err = r.resizePod(ctx, pod, patch)
+		switch {
+		case err == nil:
+			log.Log.Info("Ended the startup boost of pod", "PodSet", cr.Name, "pod", pod.Name)
+		case errors.IsNotFound(err):
+			continue
+		case errors.IsInvalid(err) || errors.IsForbidden(err) || errors.IsBadRequest(err) || errors.IsMethodNotSupported(err):
+			r.Recorder.Eventf(cr, corev1.EventTypeWarning, "StartupBoostKept", "Pod %s keeps its startup boost, it can't be resized in place: %v", pod.Name, err)
+		default:
+			return 0, err
+		}
+		if err := r.dropStartupBoost(ctx, pod); err != nil {
+			return 0, err
+		}
+	}
+	return requeueAfter, nil
+}
+
+// resizePod applies a patch of the container resources to a running pod. The resize subresource
+// is used where the API server has it, older servers with in-place resize take the patch on the
+// pod itself.
+func (r *PodSetReconciler) resizePod(ctx context.Context, pod *corev1.Pod, patch []byte) error {
+	core, err := r.coreClient()
+	if err != nil {
+		return err
+	}
+	err = core.Patch(types.StrategicMergePatchType).Namespace(pod.Namespace).Resource("pods").Name(pod.Name).
+		SubResource("resize").Body(patch).Do(ctx).Error()
+	if !errors.IsNotFound(err) {
+		return err
+	}
+	return core.Patch(types.StrategicMergePatchType).Namespace(pod.Namespace).Resource("pods").Name(pod.Name).
+		Body(patch).Do(ctx).Error()
+}
+
+// dropStartupBoost removes the annotation of a pod whose boost is over
+func (r *PodSetReconciler) dropStartupBoost(ctx context.Context, pod *corev1.Pod) error {
+	patch := client.MergeFrom(pod.DeepCopy())
+	delete(pod.Annotations, startupBoostAnnotation)
+	if err := r.Client.Patch(ctx, pod, patch); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// coreClient returns the REST client of the core API group, subresources controller-runtime's
+// client can't reach are patched with it
+func (r *PodSetReconciler) coreClient() (rest.Interface, error) {
+	r.coreMu.Lock()
+	defer r.coreMu.Unlock()
+	if r.core != nil {
+		return r.core, nil
+	}
+	if r.RestConfig == nil {
+		return nil, fmt.Errorf("no REST config to resize pods with")
+	}
+	clientset, err := kubernetes.NewForConfig(r.RestConfig)
+	if err != nil {
+		return nil, err
+	}
+	r.core = clientset.CoreV1().RESTClient()
+	return r.core, nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+// forceDeleteStuckPods force-deletes the pods that are still terminating TimeoutSeconds past their
+// deletion grace period, if their node is gone, not ready or unreachable. The kubelet of such a node
+// can't confirm the pod stopped, so it would stay around forever. A non-zero duration asks for the
+// pods to be checked again after that long.
+func (r *PodSetReconciler) forceDeleteStuckPods(ctx context.Context, cr *appv1alpha1.PodSet, pods []corev1.Pod, now time.Time) (time.Duration, error) {
+	policy := cr.Spec.ForceDeleteStuckPods
+	if policy == nil || !features.Enabled(features.ForceDeleteStuckPods) {
+		return 0, nil
+	}
+	timeout := time.Duration(policy.TimeoutSeconds) * time.Second
+
+	var requeueAfter time.Duration
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp == nil || !isPodScheduled(pod) {
+			continue
+		}
+		// the deletion timestamp is when the pod's grace period ends
+		stuckFor := now.Sub(pod.DeletionTimestamp.Time)
+		if stuckFor < timeout {
+			requeueAfter = minRequeue(requeueAfter, timeout-stuckFor)
+			continue
+		}
+
+		node := &corev1.Node{}
+		err := r.Client.Get(ctx, types.NamespacedName{Name: pod.Spec.NodeName}, node)
+		if err != nil && !errors.IsNotFound(err) {
+			return 0, err
+		}
+		if err == nil && !isNodeLost(node) {
+			// the kubelet is around and will finish the termination itself
+			continue
+		}
+
+		log.Log.Info("Force-deleting pod stuck terminating", "namespace", pod.Namespace, "pod", pod.Name, "node", pod.Spec.NodeName)
+		if err := r.Client.Delete(ctx, pod, client.GracePeriodSeconds(0)); err != nil && !errors.IsNotFound(err) {
+			return 0, err
+		}
+		r.Recorder.Eventf(cr, corev1.EventTypeWarning, "ForceDeleted",
+			"Force-deleted pod %s, terminating for %s on node %s which is not ready or unreachable", pod.Name, stuckFor.Round(time.Second), pod.Spec.NodeName)
+	}
+	return requeueAfter, nil
+}
+
+// isNodeLost tells whether the node is not ready or unreachable, so its kubelet can't be relied on
+func isNodeLost(node *corev1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == corev1.TaintNodeUnreachable {
+			return true
+		}
+	}
+	return !isNodeReady(node)
+}
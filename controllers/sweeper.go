@@ -0,0 +1,178 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+// the reasons a pod carrying PodSet labels isn't counted by any PodSet
+const (
+	// strayOrphaned pods point to a PodSet that no longer exists
+	strayOrphaned = "Orphaned"
+	// strayForeignOwned pods are controlled by something other than a PodSet
+	strayForeignOwned = "ForeignOwned"
+)
+
+const defaultSweepInterval = time.Minute
+
+var strayPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "podset_operator_stray_pods",
+	Help: "Number of pods carrying PodSet labels that no PodSet counts, by reason.",
+}, []string{"namespace", "reason"})
+
+func init() {
+	metrics.Registry.MustRegister(strayPods)
+}
+
+// StrayPodSweeper periodically looks for pods that carry PodSet labels but aren't counted
+// by any PodSet, because their PodSet is gone or another controller owns them. They are
+// reported as a metric and with events, and orphans can be deleted after a grace period.
+type StrayPodSweeper struct {
+	client.Client
+	Recorder record.EventRecorder
+
+	// Interval between two sweeps, defaults to a minute
+	Interval time.Duration
+
+	// OrphanGracePeriod is how old an orphaned pod has to be before it is deleted,
+	// orphans are only reported when it is zero. Foreign-owned pods are never deleted.
+	OrphanGracePeriod time.Duration
+
+	// reported holds the reason each stray pod was last reported for, so the event is only
+	// emitted once per pod; the metric keeps showing them
+	reported map[types.UID]string
+}
+
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Start sweeps every Interval until the context is done
+func (s *StrayPodSweeper) Start(ctx context.Context) error {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := s.sweep(ctx, time.Now()); err != nil {
+				log.Log.Error(err, "Failed to sweep stray pods")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection makes only the leader sweep, so orphans aren't deleted twice
+func (s *StrayPodSweeper) NeedLeaderElection() bool {
+	return true
+}
+
+func (s *StrayPodSweeper) sweep(ctx context.Context, now time.Time) error {
+	podSets := &appv1alpha1.PodSetList{}
+	if err := s.List(ctx, podSets); err != nil {
+		return err
+	}
+	existing := map[types.UID]bool{}
+	for _, podSet := range podSets.Items {
+		existing[podSet.UID] = true
+	}
+
+	pods := &corev1.PodList{}
+	if err := s.List(ctx, pods, client.HasLabels{podSetUIDLabel}); err != nil {
+		return err
+	}
+	strayPods.Reset()
+	if s.reported == nil {
+		s.reported = map[types.UID]string{}
+	}
+	stray := map[types.UID]bool{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		reason := strayReason(pod, existing)
+		if reason == "" {
+			continue
+		}
+		strayPods.WithLabelValues(pod.Namespace, reason).Inc()
+		if s.reported[pod.UID] != reason {
+			s.Recorder.Eventf(pod, corev1.EventTypeWarning, "Stray", "Pod carries the labels of PodSet %s but isn't counted by it: %s", pod.Labels[podSetLabel], reason)
+		}
+		s.reported[pod.UID] = reason
+		stray[pod.UID] = true
+
+		if reason != strayOrphaned || s.OrphanGracePeriod <= 0 || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if now.Sub(pod.CreationTimestamp.Time) < s.OrphanGracePeriod {
+			continue
+		}
+		log.Log.Info("deleting orphaned pod", "namespace", pod.Namespace, "pod", pod.Name)
+		if err := s.Delete(ctx, pod); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		s.Recorder.Event(pod, corev1.EventTypeNormal, "OrphanDeleted", "Deleted orphaned pod after its grace period")
+	}
+	// pods that are gone or no longer stray are forgotten
+	for uid := range s.reported {
+		if !stray[uid] {
+			delete(s.reported, uid)
+		}
+	}
+	return nil
+}
+
+// strayReason tells why no PodSet counts the pod, empty when one does. Pods without an owner
+// whose PodSet still exists aren't stray, the PodSet adopts them.
+func strayReason(pod *corev1.Pod, podSets map[types.UID]bool) string {
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil {
+		if !podSets[types.UID(pod.Labels[podSetUIDLabel])] {
+			return strayOrphaned
+		}
+		return ""
+	}
+	if !isPodSetReference(controller) {
+		return strayForeignOwned
+	}
+	if !podSets[controller.UID] {
+		return strayOrphaned
+	}
+	return ""
+}
+
+// isPodSetReference tells whether an owner reference points to a PodSet
+func isPodSetReference(ref *metav1.OwnerReference) bool {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	return err == nil && gv.Group == appv1alpha1.GroupVersion.Group && ref.Kind == "PodSet"
+}
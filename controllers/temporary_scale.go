@@ -0,0 +1,63 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+// syncTemporaryScale works out the replica count the PodSet should run and the temporary
+// scale in effect, if any. An expired temporary scale is cleared from the spec. Events mark
+// where a temporary scale starts and ends. The returned duration is when it expires.
+func (r *PodSetReconciler) syncTemporaryScale(ctx context.Context, cr *appv1alpha1.PodSet, now time.Time) (int32, *appv1alpha1.TemporaryScale, time.Duration, error) {
+	previous := cr.Status.TemporaryScale
+	scale := cr.Spec.TemporaryScale
+	if !features.Enabled(features.TemporaryScale) {
+		return cr.Spec.Replicas, nil, 0, nil
+	}
+
+	if scale != nil && !now.Before(scale.ExpiresAt.Time) {
+		log.Log.Info("temporary scale expired", "PodSet", cr.Name, "replicas", cr.Spec.Replicas)
+		patch := client.MergeFrom(cr.DeepCopy())
+		cr.Spec.TemporaryScale = nil
+		if err := r.Client.Patch(ctx, cr, patch); err != nil {
+			return 0, nil, 0, err
+		}
+		r.Recorder.Eventf(cr, corev1.EventTypeNormal, "TemporaryScaleExpired", "Temporary scale to %d replicas expired, reverted to %d replicas", scale.Replicas, cr.Spec.Replicas)
+		return cr.Spec.Replicas, nil, 0, nil
+	}
+
+	if scale == nil {
+		if previous != nil {
+			r.Recorder.Eventf(cr, corev1.EventTypeNormal, "TemporaryScaleEnded", "Temporary scale to %d replicas was removed, reverted to %d replicas", previous.Replicas, cr.Spec.Replicas)
+		}
+		return cr.Spec.Replicas, nil, 0, nil
+	}
+
+	if previous == nil || previous.Replicas != scale.Replicas || !previous.ExpiresAt.Equal(&scale.ExpiresAt) {
+		r.Recorder.Eventf(cr, corev1.EventTypeNormal, "TemporaryScaleStarted", "Scaled to %d replicas until %s", scale.Replicas, scale.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	return scale.Replicas, scale.DeepCopy(), scale.ExpiresAt.Sub(now), nil
+}
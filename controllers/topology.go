@@ -0,0 +1,154 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+// unknownZone is reported for nodes without a zone label
+const unknownZone = "unknown"
+
+var topologyPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "podset_operator_topology_pods",
+	Help: "Number of desired, ready and updated pods of a PodSet per zone and node.",
+}, []string{"namespace", "podset", "topology", "domain", "state"})
+
+// topologySeries remembers the label sets reported per PodSet, so that the ones of domains
+// the PodSet left, or of deleted PodSets, can be removed
+var topologySeries = struct {
+	sync.Mutex
+	labels map[types.NamespacedName][]prometheus.Labels
+}{labels: map[types.NamespacedName][]prometheus.Labels{}}
+
+func init() {
+	metrics.Registry.MustRegister(topologyPods)
+}
+
+// topologyStatus counts the scheduled pods per zone and per node. The zone comes from the
+// node the pod runs on, looked up in the cache.
+func (r *PodSetReconciler) topologyStatus(ctx context.Context, pods, updatedPods []corev1.Pod) (zones, nodes []appv1alpha1.TopologyDomainStatus, err error) {
+	updated := map[string]bool{}
+	for _, pod := range updatedPods {
+		updated[pod.Name] = true
+	}
+
+	zoneOf := map[string]string{}
+	byZone := map[string]*appv1alpha1.TopologyDomainStatus{}
+	byNode := map[string]*appv1alpha1.TopologyDomainStatus{}
+	for i := range pods {
+		pod := &pods[i]
+		if !isPodScheduled(pod) {
+			continue
+		}
+		nodeName := pod.Spec.NodeName
+		zone, ok := zoneOf[nodeName]
+		if !ok {
+			node := &corev1.Node{}
+			err := r.Client.Get(ctx, types.NamespacedName{Name: nodeName}, node)
+			if err != nil && !errors.IsNotFound(err) {
+				return nil, nil, err
+			}
+			zone = nodeZone(node)
+			zoneOf[nodeName] = zone
+		}
+
+		for name, domains := range map[string]map[string]*appv1alpha1.TopologyDomainStatus{zone: byZone, nodeName: byNode} {
+			domain, ok := domains[name]
+			if !ok {
+				domain = &appv1alpha1.TopologyDomainStatus{Name: name}
+				domains[name] = domain
+			}
+			domain.Desired++
+			if isPodReady(pod) {
+				domain.Ready++
+			}
+			if updated[pod.Name] {
+				domain.Updated++
+			}
+		}
+	}
+	return sortedDomains(byZone), sortedDomains(byNode), nil
+}
+
+// nodeZone is the zone the node is labelled with
+func nodeZone(node *corev1.Node) string {
+	if zone := node.Labels[corev1.LabelTopologyZone]; zone != "" {
+		return zone
+	}
+	return unknownZone
+}
+
+func sortedDomains(domains map[string]*appv1alpha1.TopologyDomainStatus) []appv1alpha1.TopologyDomainStatus {
+	var sorted []appv1alpha1.TopologyDomainStatus
+	for _, domain := range domains {
+		sorted = append(sorted, *domain)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// recordTopologyMetrics exposes the per-zone and per-node counts of a PodSet
+func recordTopologyMetrics(cr *appv1alpha1.PodSet, zones, nodes []appv1alpha1.TopologyDomainStatus) {
+	var reported []prometheus.Labels
+	for topology, domains := range map[string][]appv1alpha1.TopologyDomainStatus{"zone": zones, "node": nodes} {
+		for _, domain := range domains {
+			for state, value := range map[string]int32{"desired": domain.Desired, "ready": domain.Ready, "updated": domain.Updated} {
+				labels := prometheus.Labels{"namespace": cr.Namespace, "podset": cr.Name, "topology": topology, "domain": domain.Name, "state": state}
+				topologyPods.With(labels).Set(float64(value))
+				reported = append(reported, labels)
+			}
+		}
+	}
+
+	key := client.ObjectKeyFromObject(cr)
+	topologySeries.Lock()
+	defer topologySeries.Unlock()
+	current := map[string]bool{}
+	for _, labels := range reported {
+		current[labels["topology"]+"/"+labels["domain"]] = true
+	}
+	for _, labels := range topologySeries.labels[key] {
+		if !current[labels["topology"]+"/"+labels["domain"]] {
+			topologyPods.Delete(labels)
+		}
+	}
+	topologySeries.labels[key] = reported
+}
+
+// forgetTopologyMetrics removes the series of a deleted PodSet
+func forgetTopologyMetrics(key types.NamespacedName) {
+	topologySeries.Lock()
+	defer topologySeries.Unlock()
+	for _, labels := range topologySeries.labels[key] {
+		topologyPods.Delete(labels)
+	}
+	delete(topologySeries.labels, key)
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+)
+
+// podVersion is the version label the PodSet's pods should carry
+func podVersion(cr *appv1alpha1.PodSet) string {
+	if cr.Spec.Version == "" {
+		return legacyVersion
+	}
+	return cr.Spec.Version
+}
+
+// podVersions records the version label of every pod
+func podVersions(pods []corev1.Pod) []appv1alpha1.PodVersion {
+	var versions []appv1alpha1.PodVersion
+	for _, pod := range pods {
+		versions = append(versions, appv1alpha1.PodVersion{PodName: pod.Name, Version: pod.Labels[versionLabel]})
+	}
+	return versions
+}
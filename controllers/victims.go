@@ -0,0 +1,133 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+// VictimRanker orders the pods of a PodSet so that the ones best removed on scale-down come first
+type VictimRanker interface {
+	Rank(ctx context.Context, pods []corev1.Pod) ([]corev1.Pod, error)
+}
+
+// DefaultVictimRankers returns the built-in strategies, keyed by the name a PodSet refers to them with
+func DefaultVictimRankers(c client.Reader) map[appv1alpha1.VictimRanking]VictimRanker {
+	return map[appv1alpha1.VictimRanking]VictimRanker{
+		appv1alpha1.DefaultVictimRanking:       UnscheduledFirstRanker{},
+		appv1alpha1.ConsolidationVictimRanking: &ConsolidationRanker{Reader: c},
+	}
+}
+
+// victimRanker picks the strategy the PodSet asks for, falling back to the default one
+func (r *PodSetReconciler) victimRanker(cr *appv1alpha1.PodSet) VictimRanker {
+	// consolidation may be turned off operator-wide, the PodSets asking for it get the default
+	if cr.Spec.ScaleDown != nil && (cr.Spec.ScaleDown.VictimRanking != appv1alpha1.ConsolidationVictimRanking || features.Enabled(features.ConsolidationVictimRanking)) {
+		if ranker, ok := r.VictimRankers[cr.Spec.ScaleDown.VictimRanking]; ok {
+			return ranker
+		}
+	}
+	if ranker, ok := r.VictimRankers[appv1alpha1.DefaultVictimRanking]; ok {
+		return ranker
+	}
+	return UnscheduledFirstRanker{}
+}
+
+// UnscheduledFirstRanker removes the pods still waiting for a node first and otherwise keeps the order
+type UnscheduledFirstRanker struct{}
+
+// Rank implements VictimRanker
+func (UnscheduledFirstRanker) Rank(_ context.Context, pods []corev1.Pod) ([]corev1.Pod, error) {
+	sortUnscheduledFirst(pods)
+	return pods, nil
+}
+
+// ConsolidationRanker removes pods from the nodes that would become the emptiest first, helping
+// the cluster autoscaler to free them. Node allocatable and the requests of the pods bound to
+// a node are read from the cache.
+type ConsolidationRanker struct {
+	client.Reader
+}
+
+// Rank implements VictimRanker
+func (c *ConsolidationRanker) Rank(ctx context.Context, pods []corev1.Pod) ([]corev1.Pod, error) {
+	type nodeState struct {
+		allocatable corev1.ResourceList
+		requested   corev1.ResourceList
+		// missing nodes were deleted while pods were still bound to them
+		missing bool
+	}
+	nodes := map[string]*nodeState{}
+	var ranked, scheduled []corev1.Pod
+	for _, pod := range pods {
+		if !isPodScheduled(&pod) {
+			ranked = append(ranked, pod)
+			continue
+		}
+		scheduled = append(scheduled, pod)
+		if _, ok := nodes[pod.Spec.NodeName]; ok {
+			continue
+		}
+		node := &corev1.Node{}
+		if err := c.Get(ctx, types.NamespacedName{Name: pod.Spec.NodeName}, node); err != nil {
+			if !errors.IsNotFound(err) {
+				return nil, err
+			}
+			nodes[pod.Spec.NodeName] = &nodeState{missing: true}
+			continue
+		}
+		requested, _, err := nodeRequested(ctx, c, pod.Spec.NodeName)
+		if err != nil {
+			return nil, err
+		}
+		nodes[pod.Spec.NodeName] = &nodeState{allocatable: node.Status.Allocatable, requested: requested}
+	}
+
+	// greedily take the pod whose removal leaves its node the emptiest, then account for its
+	// removal so the next pick sees the node as it would be
+	for len(scheduled) > 0 {
+		best, bestUtilization := 0, 0.0
+		for i := range scheduled {
+			node := nodes[scheduled[i].Spec.NodeName]
+			// the pods of a missing node go first, they can't be running anyway
+			u := -1.0
+			if !node.missing {
+				remaining := node.requested.DeepCopy()
+				subtractResources(remaining, podRequests(&scheduled[i]))
+				u = utilization(remaining, node.allocatable)
+			}
+			if i == 0 || u < bestUtilization {
+				best, bestUtilization = i, u
+			}
+		}
+		victim := scheduled[best]
+		if node := nodes[victim.Spec.NodeName]; !node.missing {
+			subtractResources(node.requested, podRequests(&victim))
+		}
+		ranked = append(ranked, victim)
+		scheduled = append(scheduled[:best], scheduled[best+1:]...)
+	}
+	return ranked, nil
+}
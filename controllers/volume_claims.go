@@ -0,0 +1,268 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+// volumeSeedTimeout is how long a cloned PVC may take to get bound before cloning is given up on
+const volumeSeedTimeout = 5 * time.Minute
+
+//+kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;create
+
+// hasVolumeClaims tells whether the pods of the PodSet get PVCs of their own
+func hasVolumeClaims(cr *appv1alpha1.PodSet) bool {
+	return len(cr.Spec.VolumeClaimTemplates) > 0 && features.Enabled(features.VolumeClaimTemplates)
+}
+
+// volumeClaimName names the PVC a pod gets from a volume claim template
+func volumeClaimName(template *appv1alpha1.VolumeClaimTemplate, pod *corev1.Pod) string {
+	return template.Metadata.Name + "-" + pod.Name
+}
+
+// addVolumeClaims mounts the PVCs of the volume claim templates in a new pod. The PVCs are
+// named after the pod, so the pod is given its name up front instead of having it generated.
+// Calling it again after renaming the pod points the volumes at the new PVC names.
+func addVolumeClaims(cr *appv1alpha1.PodSet, pod *corev1.Pod) {
+	if !hasVolumeClaims(cr) {
+		return
+	}
+	if pod.Name == "" {
+		pod.Name = pod.GenerateName + rand.String(5)
+		pod.GenerateName = ""
+	}
+	for i := range cr.Spec.VolumeClaimTemplates {
+		template := &cr.Spec.VolumeClaimTemplates[i]
+		source := corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: volumeClaimName(template, pod)},
+		}
+		found := false
+		for j := range pod.Spec.Volumes {
+			if pod.Spec.Volumes[j].Name == template.Metadata.Name {
+				pod.Spec.Volumes[j].VolumeSource = source
+				found = true
+			}
+		}
+		if !found {
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: template.Metadata.Name, VolumeSource: source})
+		}
+	}
+}
+
+// mountsClaim tells whether the pod has a volume of the PVC, pods created before a template was
+// added don't
+func mountsClaim(pod *corev1.Pod, name string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// syncVolumeClaims creates the missing PVCs of the pods, cloned from the PVCs of a ready pod if
+// the PodSet asks for it. A pod whose cloned PVC doesn't get bound in time is deleted, its PVCs
+// go with it, and new PVCs are created empty until the spec changes. A non-zero duration asks
+// for the PVCs to be checked again after that long.
+func (r *PodSetReconciler) syncVolumeClaims(ctx context.Context, cr *appv1alpha1.PodSet, pods []corev1.Pod, status *appv1alpha1.PodSetStatus, now time.Time) (time.Duration, error) {
+	seed := cr.Spec.VolumeSeed != nil && cr.Spec.VolumeSeed.FromReadyReplica
+	if !hasVolumeClaims(cr) || !seed {
+		meta.RemoveStatusCondition(&status.Conditions, appv1alpha1.ConditionVolumeCloning)
+	}
+	if !hasVolumeClaims(cr) {
+		return 0, nil
+	}
+	if condition := meta.FindStatusCondition(status.Conditions, appv1alpha1.ConditionVolumeCloning); condition != nil &&
+		condition.Status == metav1.ConditionFalse && condition.ObservedGeneration == cr.Generation {
+		seed = false
+	}
+
+	claimList := &corev1.PersistentVolumeClaimList{}
+	if err := r.Client.List(ctx, claimList, client.InNamespace(cr.Namespace), client.MatchingLabels{podSetUIDLabel: string(cr.UID)}); err != nil {
+		return 0, err
+	}
+	claims := map[string]*corev1.PersistentVolumeClaim{}
+	for i := range claimList.Items {
+		claims[claimList.Items[i].Name] = &claimList.Items[i]
+	}
+
+	// PVCs are created with the same identity as the pods
+	creator, err := r.podCreator(cr)
+	if err != nil {
+		return 0, err
+	}
+	var requeueAfter time.Duration
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		for j := range cr.Spec.VolumeClaimTemplates {
+			template := &cr.Spec.VolumeClaimTemplates[j]
+			name := volumeClaimName(template, pod)
+			if !mountsClaim(pod, name) {
+				continue
+			}
+
+			claim, ok := claims[name]
+			if !ok {
+				var source *corev1.PersistentVolumeClaim
+				if seed {
+					source = seedSource(template, pods, claims, pod)
+				}
+				claim = newVolumeClaim(cr, template, name, source)
+				// the PVC goes away with its pod, pods are never recreated under the same name to pick it up again
+				if err := controllerutil.SetOwnerReference(pod, claim, r.Scheme); err != nil {
+					return 0, err
+				}
+				log.Log.Info("Creating PVC of Pod", "namespace", cr.Namespace, "pod", pod.Name, "pvc", name, "seededFrom", claim.Annotations[seededFromAnnotation])
+				if err := creator.Create(ctx, claim); err != nil && !errors.IsAlreadyExists(err) {
+					return 0, err
+				}
+				if source != nil {
+					requeueAfter = minRequeue(requeueAfter, volumeSeedTimeout)
+				}
+				continue
+			}
+
+			sourcePod, seeded := claim.Annotations[seededFromAnnotation]
+			if !seeded {
+				continue
+			}
+			if claim.Status.Phase == corev1.ClaimBound {
+				if seed {
+					meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+						Type:               appv1alpha1.ConditionVolumeCloning,
+						Status:             metav1.ConditionTrue,
+						ObservedGeneration: cr.Generation,
+						Reason:             "Cloned",
+						Message:            "the PVCs of new pods are cloned from a ready pod",
+					})
+				}
+				continue
+			}
+			if waited := now.Sub(claim.CreationTimestamp.Time); waited < volumeSeedTimeout {
+				requeueAfter = minRequeue(requeueAfter, volumeSeedTimeout-waited)
+				continue
+			}
+
+			// the storage didn't clone the volume, the pod is replaced by one with empty volumes
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               appv1alpha1.ConditionVolumeCloning,
+				Status:             metav1.ConditionFalse,
+				ObservedGeneration: cr.Generation,
+				Reason:             "CloneTimedOut",
+				Message:            fmt.Sprintf("PVC %s cloned from pod %s wasn't bound within %s, new PVCs are created empty", name, sourcePod, volumeSeedTimeout),
+			})
+			r.Recorder.Eventf(cr, corev1.EventTypeWarning, "VolumeSeedFailed", "PVC %s cloned from pod %s wasn't bound within %s, replacing pod %s with one with empty volumes",
+				name, sourcePod, volumeSeedTimeout, pod.Name)
+			seed = false
+			if err := r.Client.Delete(ctx, pod); err != nil && !errors.IsNotFound(err) {
+				return 0, err
+			}
+			break
+		}
+	}
+	return requeueAfter, nil
+}
+
+// seedSource picks the PVC a new PVC of the pod is cloned from: the bound PVC of the same
+// template of a ready pod, the first by name. It returns nil if no pod is ready yet.
+func seedSource(template *appv1alpha1.VolumeClaimTemplate, pods []corev1.Pod, claims map[string]*corev1.PersistentVolumeClaim, pod *corev1.Pod) *corev1.PersistentVolumeClaim {
+	var candidates []*corev1.PersistentVolumeClaim
+	for i := range pods {
+		other := &pods[i]
+		if other.Name == pod.Name || other.DeletionTimestamp != nil || !isPodReady(other) {
+			continue
+		}
+		claim, ok := claims[volumeClaimName(template, other)]
+		if !ok || claim.DeletionTimestamp != nil || claim.Status.Phase != corev1.ClaimBound {
+			continue
+		}
+		candidates = append(candidates, claim)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates[0]
+}
+
+// newVolumeClaim makes the PVC of a pod from a volume claim template, as a clone of the source
+// PVC if there is one. A clone has to be at least as large as its source, which may have been
+// expanded since it was created.
+func newVolumeClaim(cr *appv1alpha1.PodSet, template *appv1alpha1.VolumeClaimTemplate, name string, source *corev1.PersistentVolumeClaim) *corev1.PersistentVolumeClaim {
+	labels := map[string]string{}
+	for key, value := range template.Metadata.Labels {
+		labels[key] = value
+	}
+	labels[podSetLabel] = cr.Name
+	labels[podSetUIDLabel] = string(cr.UID)
+
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: *template.Spec.DeepCopy(),
+	}
+	if len(template.Metadata.Annotations) > 0 {
+		claim.Annotations = map[string]string{}
+		for key, value := range template.Metadata.Annotations {
+			claim.Annotations[key] = value
+		}
+	}
+	if source == nil {
+		return claim
+	}
+
+	if claim.Annotations == nil {
+		claim.Annotations = map[string]string{}
+	}
+	// the source is named <template>-<pod>
+	claim.Annotations[seededFromAnnotation] = source.Name[len(template.Metadata.Name)+1:]
+	claim.Spec.DataSource = &corev1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: source.Name}
+	claim.Spec.DataSourceRef = nil
+	if capacity, ok := source.Status.Capacity[corev1.ResourceStorage]; ok {
+		if request := claim.Spec.Resources.Requests[corev1.ResourceStorage]; capacity.Cmp(request) > 0 {
+			if claim.Spec.Resources.Requests == nil {
+				claim.Spec.Resources.Requests = corev1.ResourceList{}
+			}
+			claim.Spec.Resources.Requests[corev1.ResourceStorage] = capacity.DeepCopy()
+		}
+	}
+	return claim
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
+	"github.com/pk-218/pod-set/pkg/features"
+)
+
+func TestSeedSource(t *testing.T) {
+	template := &appv1alpha1.VolumeClaimTemplate{Metadata: appv1alpha1.VolumeClaimTemplateMetadata{Name: "data"}}
+	pod := func(name string, ready bool) corev1.Pod {
+		status := corev1.ConditionFalse
+		if ready {
+			status = corev1.ConditionTrue
+		}
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}},
+		}
+	}
+	claim := func(name string, phase corev1.PersistentVolumeClaimPhase) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name}, Status: corev1.PersistentVolumeClaimStatus{Phase: phase}}
+	}
+	newPod := pod("web-new", false)
+
+	tests := []struct {
+		name   string
+		pods   []corev1.Pod
+		claims []*corev1.PersistentVolumeClaim
+		want   string
+	}{
+		{name: "no other pods", pods: []corev1.Pod{newPod}},
+		{
+			name:   "first ready pod by name",
+			pods:   []corev1.Pod{pod("web-b", true), pod("web-a", true), newPod},
+			claims: []*corev1.PersistentVolumeClaim{claim("data-web-a", corev1.ClaimBound), claim("data-web-b", corev1.ClaimBound)},
+			want:   "data-web-a",
+		},
+		{
+			name:   "unready pods are skipped",
+			pods:   []corev1.Pod{pod("web-a", false), pod("web-b", true), newPod},
+			claims: []*corev1.PersistentVolumeClaim{claim("data-web-a", corev1.ClaimBound), claim("data-web-b", corev1.ClaimBound)},
+			want:   "data-web-b",
+		},
+		{
+			name:   "unbound PVCs are skipped",
+			pods:   []corev1.Pod{pod("web-a", true), pod("web-b", true), newPod},
+			claims: []*corev1.PersistentVolumeClaim{claim("data-web-a", corev1.ClaimPending), claim("data-web-b", corev1.ClaimBound)},
+			want:   "data-web-b",
+		},
+		{
+			name: "ready pods without a PVC are skipped",
+			pods: []corev1.Pod{pod("web-a", true), newPod},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]*corev1.PersistentVolumeClaim{}
+			for _, claim := range tt.claims {
+				claims[claim.Name] = claim
+			}
+			got := ""
+			if source := seedSource(template, tt.pods, claims, &newPod); source != nil {
+				got = source.Name
+			}
+			if got != tt.want {
+				t.Errorf("seedSource() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewVolumeClaim(t *testing.T) {
+	cr := &appv1alpha1.PodSet{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "uid"}}
+	template := &appv1alpha1.VolumeClaimTemplate{
+		Metadata: appv1alpha1.VolumeClaimTemplateMetadata{Name: "data", Labels: map[string]string{"tier": "cache"}},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}},
+		},
+	}
+	source := func(capacity string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data-web-a"},
+			Status:     corev1.PersistentVolumeClaimStatus{Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(capacity)}},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		source         *corev1.PersistentVolumeClaim
+		wantSize       string
+		wantSeededFrom string
+	}{
+		{name: "empty", wantSize: "10Gi"},
+		{name: "clone", source: source("10Gi"), wantSize: "10Gi", wantSeededFrom: "web-a"},
+		{name: "clone of an expanded PVC", source: source("20Gi"), wantSize: "20Gi", wantSeededFrom: "web-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claim := newVolumeClaim(cr, template, "data-web-b", tt.source)
+			if claim.Name != "data-web-b" || claim.Namespace != "default" {
+				t.Errorf("PVC is %s/%s, want default/data-web-b", claim.Namespace, claim.Name)
+			}
+			if claim.Labels["tier"] != "cache" || claim.Labels[podSetUIDLabel] != "uid" {
+				t.Errorf("PVC labels = %v", claim.Labels)
+			}
+			if size := claim.Spec.Resources.Requests[corev1.ResourceStorage]; size.Cmp(resource.MustParse(tt.wantSize)) != 0 {
+				t.Errorf("PVC requests %s, want %s", size.String(), tt.wantSize)
+			}
+			if got := claim.Annotations[seededFromAnnotation]; got != tt.wantSeededFrom {
+				t.Errorf("PVC seeded from %q, want %q", got, tt.wantSeededFrom)
+			}
+			if tt.source == nil {
+				if claim.Spec.DataSource != nil {
+					t.Errorf("an empty PVC has data source %v", claim.Spec.DataSource)
+				}
+			} else if ds := claim.Spec.DataSource; ds == nil || ds.Kind != "PersistentVolumeClaim" || ds.Name != tt.source.Name {
+				t.Errorf("PVC data source = %v, want PVC %s", ds, tt.source.Name)
+			}
+			// the template isn't changed by a clone
+			if size := template.Spec.Resources.Requests[corev1.ResourceStorage]; size.Cmp(resource.MustParse("10Gi")) != 0 {
+				t.Errorf("template now requests %s", size.String())
+			}
+		})
+	}
+}
+
+func TestAddVolumeClaims(t *testing.T) {
+	if err := features.Gate.SetFromMap(map[string]bool{string(features.VolumeClaimTemplates): true}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = features.Gate.SetFromMap(map[string]bool{string(features.VolumeClaimTemplates): false})
+	}()
+
+	cr := &appv1alpha1.PodSet{Spec: appv1alpha1.PodSetSpec{VolumeClaimTemplates: []appv1alpha1.VolumeClaimTemplate{
+		{Metadata: appv1alpha1.VolumeClaimTemplateMetadata{Name: "data"}},
+		{Metadata: appv1alpha1.VolumeClaimTemplateMetadata{Name: "logs"}},
+	}}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "web-pod-"},
+		Spec: corev1.PodSpec{Volumes: []corev1.Volume{
+			{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			{Name: "config", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		}},
+	}
+	addVolumeClaims(cr, pod)
+	if pod.Name == "" || pod.GenerateName != "" {
+		t.Fatalf("pod wasn't named up front: name %q, generateName %q", pod.Name, pod.GenerateName)
+	}
+	for _, name := range []string{"data", "logs"} {
+		if claim := name + "-" + pod.Name; !mountsClaim(pod, claim) {
+			t.Errorf("pod doesn't mount %s", claim)
+		}
+	}
+	if len(pod.Spec.Volumes) != 3 || pod.Spec.Volumes[1].EmptyDir == nil {
+		t.Errorf("pod volumes = %v, want data replaced, config kept and logs added", pod.Spec.Volumes)
+	}
+
+	// renaming the pod points the volumes at the new PVCs
+	pod.Name = "web-pod-renamed"
+	addVolumeClaims(cr, pod)
+	if !mountsClaim(pod, "data-web-pod-renamed") || !mountsClaim(pod, "logs-web-pod-renamed") || len(pod.Spec.Volumes) != 3 {
+		t.Errorf("pod volumes after renaming = %v", pod.Spec.Volumes)
+	}
+}
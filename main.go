@@ -19,20 +19,30 @@ package main
 import (
 	"flag"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	cliflag "k8s.io/component-base/cli/flag"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	configv1alpha1 "github.com/pk-218/pod-set/api/config/v1alpha1"
 	appv1alpha1 "github.com/pk-218/pod-set/api/v1alpha1"
 	"github.com/pk-218/pod-set/controllers"
+	"github.com/pk-218/pod-set/pkg/features"
+	"github.com/pk-218/pod-set/pkg/webhookcert"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -43,8 +53,10 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
 
 	utilruntime.Must(appv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(configv1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -52,11 +64,51 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var webhookCertManagement bool
+	var webhookCertSecret string
+	var webhookServiceName string
+	var webhookCertDir string
+	var mutatingWebhookConfigurations []string
+	var validatingWebhookConfigurations []string
+	var configFile string
+	var sweepInterval time.Duration
+	var orphanGracePeriod time.Duration
+	var creatorServiceAccount string
+	var rebalanceInterval time.Duration
+	featureGates := map[string]bool{}
+	flag.StringVar(&configFile, "config", "",
+		"The controller will load its initial configuration from this file. "+
+			"Omit this flag to use the default configuration values. "+
+			"The metrics, probe and leader election flags are ignored when it is set.")
+	flag.Var(cliflag.NewMapStringBool(&featureGates), "feature-gates",
+		"A set of key=value pairs that turn features on or off, taking precedence over the config file. Options are:\n"+
+			strings.Join(features.Gate.KnownFeatures(), "\n"))
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&webhookCertManagement, "webhook-cert-management", false,
+		"Generate and rotate the webhook serving certificate in-process instead of relying on cert-manager.")
+	flag.StringVar(&webhookCertSecret, "webhook-cert-secret", "podset-operator-webhook-server-cert",
+		"The Secret the in-process webhook certificates are stored in.")
+	flag.StringVar(&webhookServiceName, "webhook-service-name", "podset-operator-webhook-service",
+		"The Service in front of the webhook server, its DNS names are put in the serving certificate.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs"),
+		"The directory the webhook server reads its serving certificate from.")
+	flag.Var(cliflag.NewStringSlice(&mutatingWebhookConfigurations), "mutating-webhook-configurations",
+		"Comma separated MutatingWebhookConfigurations the in-process webhook CA is injected into.")
+	flag.Var(cliflag.NewStringSlice(&validatingWebhookConfigurations), "validating-webhook-configurations",
+		"Comma separated ValidatingWebhookConfigurations the in-process webhook CA is injected into.")
+	flag.DurationVar(&sweepInterval, "stray-pod-sweep-interval", time.Minute,
+		"How often to look for pods carrying PodSet labels that no PodSet counts.")
+	flag.DurationVar(&orphanGracePeriod, "orphan-pod-grace-period", 0,
+		"Delete pods whose PodSet no longer exists once they are this old, 0 only reports them.")
+	flag.StringVar(&creatorServiceAccount, "pod-creator-service-account", "",
+		"The ServiceAccount, in each PodSet's namespace, impersonated to create pods unless the PodSet sets spec.creatorServiceAccount. "+
+			"Pods are created as the operator itself when empty.")
+	flag.DurationVar(&rebalanceInterval, "rebalance-interval", time.Minute,
+		"How often to check PodSets with spec.rebalance for pods spread unevenly across zones or nodes.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -65,28 +117,130 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	var err error
+	labelPrefix := controllers.DefaultLabelPrefix
+	legacyLabelSelection := false
+	options := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "319079fc.github.com",
-	})
+	}
+	if configFile != "" {
+		projectConfig := configv1alpha1.ProjectConfig{}
+		options, err = ctrl.Options{Scheme: scheme}.AndFrom(ctrl.ConfigFile().AtPath(configFile).OfKind(&projectConfig))
+		if err != nil {
+			setupLog.Error(err, "unable to load the config file")
+			os.Exit(1)
+		}
+		if err = features.Gate.SetFromMap(projectConfig.FeatureGates); err != nil {
+			setupLog.Error(err, "invalid feature gates in the config file")
+			os.Exit(1)
+		}
+		if labels := projectConfig.Labels; labels != nil {
+			if labels.Prefix != "" {
+				labelPrefix = labels.Prefix
+			}
+			if labels.LegacySelection != nil {
+				legacyLabelSelection = *labels.LegacySelection
+			}
+		}
+	}
+	if err = controllers.SetLabelPrefix(labelPrefix); err != nil {
+		setupLog.Error(err, "invalid label prefix in the config file")
+		os.Exit(1)
+	}
+	if options.CertDir == "" {
+		options.CertDir = webhookCertDir
+	}
+	if err = features.Gate.SetFromMap(featureGates); err != nil {
+		setupLog.Error(err, "invalid --feature-gates")
+		os.Exit(1)
+	}
+	logFeatureGates()
+	features.RecordMetrics()
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	// pods would silently be created as the operator instead of the ServiceAccount asked for
+	if creatorServiceAccount != "" && !features.Enabled(features.CreatorImpersonation) {
+		setupLog.Error(nil, "--pod-creator-service-account needs the CreatorImpersonation feature gate")
+		os.Exit(1)
+	}
 	if err = (&controllers.PodSetReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                mgr.GetClient(),
+		Scheme:                mgr.GetScheme(),
+		LegacyLabelSelection:  legacyLabelSelection,
+		CreatorServiceAccount: creatorServiceAccount,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PodSet")
 		os.Exit(1)
 	}
+	if features.Enabled(features.MultiClusterPodSet) {
+		if err = (&controllers.MultiClusterPodSetReconciler{
+			Client: mgr.GetClient(),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "MultiClusterPodSet")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
+	if err = mgr.Add(&controllers.StrayPodSweeper{
+		Client:            mgr.GetClient(),
+		Recorder:          mgr.GetEventRecorderFor("podset-controller"),
+		Interval:          sweepInterval,
+		OrphanGracePeriod: orphanGracePeriod,
+	}); err != nil {
+		setupLog.Error(err, "unable to set up the stray pod sweeper")
+		os.Exit(1)
+	}
+	if features.Enabled(features.TopologyRebalance) {
+		if err = mgr.Add(&controllers.TopologyRebalancer{
+			Client:   mgr.GetClient(),
+			Recorder: mgr.GetEventRecorderFor("podset-controller"),
+			Interval: rebalanceInterval,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up the topology rebalancer")
+			os.Exit(1)
+		}
+	}
+
+	ctx := ctrl.SetupSignalHandler()
+	if webhookCertManagement {
+		// the caches aren't running yet, the certificate has to be on disk before the webhook server starts
+		certClient, err := client.New(mgr.GetConfig(), client.Options{Scheme: scheme})
+		if err != nil {
+			setupLog.Error(err, "unable to create webhook certificate client")
+			os.Exit(1)
+		}
+		certManager := &webhookcert.Manager{
+			Client:                          certClient,
+			SecretName:                      webhookCertSecret,
+			Namespace:                       operatorNamespace(),
+			ServiceName:                     webhookServiceName,
+			CertDir:                         options.CertDir,
+			MutatingWebhookConfigurations:   mutatingWebhookConfigurations,
+			ValidatingWebhookConfigurations: validatingWebhookConfigurations,
+			CustomResourceDefinitions:       []string{"podsets.app.github.com", "multiclusterpodsets.app.github.com"},
+		}
+		if err := certManager.Ensure(ctx); err != nil {
+			setupLog.Error(err, "unable to provision webhook serving certificate")
+			os.Exit(1)
+		}
+		if err := mgr.Add(certManager); err != nil {
+			setupLog.Error(err, "unable to set up webhook certificate rotation")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -97,8 +251,32 @@ func main() {
 	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
+
+// logFeatureGates logs which features are on and off, in a stable order
+func logFeatureGates() {
+	var enabled, disabled []string
+	for name, on := range features.Active() {
+		if on {
+			enabled = append(enabled, name)
+		} else {
+			disabled = append(disabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	sort.Strings(disabled)
+	setupLog.Info("feature gates", "enabled", enabled, "disabled", disabled)
+}
+
+// operatorNamespace is the namespace the operator runs in, as mounted with its service account token
+func operatorNamespace() string {
+	namespace, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return "podset-operator-system"
+	}
+	return strings.TrimSpace(string(namespace))
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package features holds the feature gates of the operator. New capabilities are added as
+// alpha (off by default), move to beta (on by default) once proven and to GA when the gate
+// can no longer be turned off.
+package features
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/component-base/featuregate"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// ImagePrePull pulls the images of a new revision onto the nodes before rolling it out
+	ImagePrePull featuregate.Feature = "ImagePrePull"
+
+	// RolloutHooks runs the pre- and post-rollout hook Jobs of a PodSet
+	RolloutHooks featuregate.Feature = "RolloutHooks"
+
+	// CapacityCheck holds back scale-ups that don't fit on the nodes
+	CapacityCheck featuregate.Feature = "CapacityCheck"
+
+	// ConsolidationVictimRanking lets PodSets remove pods from the least utilized nodes on scale-down
+	ConsolidationVictimRanking featuregate.Feature = "ConsolidationVictimRanking"
+
+	// MultiClusterPodSet runs the controller spreading MultiClusterPodSets across member clusters
+	MultiClusterPodSet featuregate.Feature = "MultiClusterPodSet"
+
+	// Quarantine sets pods annotated for quarantine aside for inspection
+	Quarantine featuregate.Feature = "Quarantine"
+
+	// TemporaryScale lets PodSets override their replica count until a deadline
+	TemporaryScale featuregate.Feature = "TemporaryScale"
+
+	// CreatorImpersonation creates the workload of PodSets as a creator ServiceAccount
+	CreatorImpersonation featuregate.Feature = "CreatorImpersonation"
+
+	// AvailabilitySLO tracks PodSets against an availability objective and its error budget
+	AvailabilitySLO featuregate.Feature = "AvailabilitySLO"
+
+	// TopologyRebalance moves pods to under-populated zones or nodes
+	TopologyRebalance featuregate.Feature = "TopologyRebalance"
+
+	// ForceDeleteStuckPods force-deletes pods stuck terminating on lost nodes
+	ForceDeleteStuckPods featuregate.Feature = "ForceDeleteStuckPods"
+
+	// LeaderElection elects a leader pod of a PodSet and targets it with a Service
+	LeaderElection featuregate.Feature = "LeaderElection"
+
+	// PerNodePlacement runs one pod of a PodSet on every eligible node
+	PerNodePlacement featuregate.Feature = "PerNodePlacement"
+
+	// StartupBoost gives starting pods extra CPU, taken away with an in-place resize
+	StartupBoost featuregate.Feature = "StartupBoost"
+
+	// VolumeClaimTemplates gives every pod of a PodSet its own PVCs, optionally cloned from a ready pod
+	VolumeClaimTemplates featuregate.Feature = "VolumeClaimTemplates"
+)
+
+var defaultFeatureGates = map[featuregate.Feature]featuregate.FeatureSpec{
+	CapacityCheck:              {Default: true, PreRelease: featuregate.Beta},
+	ConsolidationVictimRanking: {Default: true, PreRelease: featuregate.Beta},
+	ImagePrePull:               {Default: false, PreRelease: featuregate.Alpha},
+	RolloutHooks:               {Default: false, PreRelease: featuregate.Alpha},
+	MultiClusterPodSet:         {Default: false, PreRelease: featuregate.Alpha},
+	Quarantine:                 {Default: false, PreRelease: featuregate.Alpha},
+	TemporaryScale:             {Default: false, PreRelease: featuregate.Alpha},
+	CreatorImpersonation:       {Default: false, PreRelease: featuregate.Alpha},
+	AvailabilitySLO:            {Default: false, PreRelease: featuregate.Alpha},
+	TopologyRebalance:          {Default: false, PreRelease: featuregate.Alpha},
+	ForceDeleteStuckPods:       {Default: false, PreRelease: featuregate.Alpha},
+	LeaderElection:             {Default: false, PreRelease: featuregate.Alpha},
+	PerNodePlacement:           {Default: false, PreRelease: featuregate.Alpha},
+	StartupBoost:               {Default: false, PreRelease: featuregate.Alpha},
+	VolumeClaimTemplates:       {Default: false, PreRelease: featuregate.Alpha},
+}
+
+// Gate is the feature gate consulted throughout the operator, it is set up once at startup
+var Gate featuregate.MutableFeatureGate = featuregate.NewFeatureGate()
+
+var featureEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "podset_operator_feature_enabled",
+	Help: "Whether a feature gate of the operator is enabled (1) or disabled (0).",
+}, []string{"name", "stage"})
+
+func init() {
+	utilruntime.Must(Gate.Add(defaultFeatureGates))
+	metrics.Registry.MustRegister(featureEnabled)
+}
+
+// Enabled tells whether a feature is turned on
+func Enabled(feature featuregate.Feature) bool {
+	return Gate.Enabled(feature)
+}
+
+// Active lists the operator's features with whether they are enabled
+func Active() map[string]bool {
+	active := map[string]bool{}
+	for feature := range defaultFeatureGates {
+		active[string(feature)] = Gate.Enabled(feature)
+	}
+	return active
+}
+
+// RecordMetrics exposes the state of every feature gate, it is called once the gates are set
+func RecordMetrics() {
+	for feature, spec := range defaultFeatureGates {
+		stage := string(spec.PreRelease)
+		if stage == "" {
+			stage = "GA"
+		}
+		value := 0.0
+		if Gate.Enabled(feature) {
+			value = 1
+		}
+		featureEnabled.WithLabelValues(string(feature), stage).Set(value)
+	}
+}
@@ -0,0 +1,403 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhookcert manages the serving certificate of the webhook server in-process,
+// so the webhooks can be enabled without installing cert-manager
+package webhookcert
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	caCertKey         = "ca.crt"
+	caKeyKey          = "ca.key"
+	previousCACertKey = "ca-previous.crt"
+
+	defaultCAValidity    = 10 * 365 * 24 * time.Hour
+	defaultCertValidity  = 365 * 24 * time.Hour
+	defaultRotateBefore  = 30 * 24 * time.Hour
+	defaultCheckInterval = time.Hour
+)
+
+// the Secret is only read and written in the operator namespace, see config/rbac/webhook_cert_role.yaml
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations;validatingwebhookconfigurations,verbs=get;list;watch;update
+//+kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;list;watch;update
+
+// Manager keeps a self-signed CA and a serving certificate in a Secret, writes the serving
+// certificate to the webhook server's CertDir and injects the CA into the webhook
+// configurations and the CRD conversion webhooks. The certificates are issued again
+// before they expire; a replaced CA stays in the CA bundle until it expires itself.
+type Manager struct {
+	// Client should not be cached, the manager is used before the caches are started
+	Client client.Client
+
+	// SecretName and Namespace locate the Secret holding the certificates
+	SecretName string
+	Namespace  string
+	// ServiceName is the Service in front of the webhook server, its DNS names end up in the certificate
+	ServiceName string
+	// CertDir is where the webhook server reads tls.crt and tls.key from
+	CertDir string
+
+	// the webhook configurations and CRDs to inject the CA bundle into, missing ones are skipped
+	MutatingWebhookConfigurations   []string
+	ValidatingWebhookConfigurations []string
+	CustomResourceDefinitions       []string
+
+	// CAValidity and CertValidity default to ten years and one year, certificates are
+	// replaced RotateBefore (30 days) ahead of their expiry, checked every CheckInterval (an hour)
+	CAValidity    time.Duration
+	CertValidity  time.Duration
+	RotateBefore  time.Duration
+	CheckInterval time.Duration
+}
+
+// Start checks the certificates every CheckInterval until the context is done.
+// Ensure should be called once before the webhook server starts.
+func (m *Manager) Start(ctx context.Context) error {
+	ticker := time.NewTicker(orDefault(m.CheckInterval, defaultCheckInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := m.Ensure(ctx); err != nil {
+				log.Log.Error(err, "unable to rotate the webhook serving certificate", "Secret", m.SecretName)
+			}
+		}
+	}
+}
+
+// NeedLeaderElection is false, every replica serves webhooks and needs the certificate on disk
+func (m *Manager) NeedLeaderElection() bool {
+	return false
+}
+
+// Ensure issues the certificates if they are missing or about to expire, then injects the
+// CA bundle and writes them to CertDir
+func (m *Manager) Ensure(ctx context.Context) error {
+	secret, err := m.ensureSecret(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	// the new CA has to be trusted before a certificate signed by it is served
+	if err := m.injectCABundle(ctx, caBundle(secret, time.Now())); err != nil {
+		return err
+	}
+	return m.writeCertDir(secret)
+}
+
+// ensureSecret returns the Secret with valid certificates, replacing them when needed.
+// Replicas racing on the Secret pick up whatever the winner stored.
+func (m *Manager) ensureSecret(ctx context.Context, now time.Time) (*corev1.Secret, error) {
+	key := types.NamespacedName{Namespace: m.Namespace, Name: m.SecretName}
+	secret := &corev1.Secret{}
+	err := m.Client.Get(ctx, key, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	exists := err == nil
+	if exists && !m.needsRotation(secret, now) {
+		return secret, nil
+	}
+
+	data, err := m.issue(secret.Data, now)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: m.SecretName, Namespace: m.Namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       data,
+		}
+		log.Log.Info("creating webhook serving certificate", "Secret", m.SecretName)
+		err = m.Client.Create(ctx, secret)
+	} else {
+		secret.Data = data
+		log.Log.Info("rotating webhook serving certificate", "Secret", m.SecretName)
+		err = m.Client.Update(ctx, secret)
+	}
+	if errors.IsAlreadyExists(err) || errors.IsConflict(err) {
+		secret = &corev1.Secret{}
+		err = m.Client.Get(ctx, key, secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// needsRotation tells whether the stored certificates are unusable, about to expire or
+// don't match the service anymore
+func (m *Manager) needsRotation(secret *corev1.Secret, now time.Time) bool {
+	rotateBefore := orDefault(m.RotateBefore, defaultRotateBefore)
+	ca, err := parseCertificate(secret.Data[caCertKey])
+	if err != nil || now.Add(rotateBefore).After(ca.NotAfter) {
+		return true
+	}
+	if _, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]); err != nil {
+		return true
+	}
+	cert, err := parseCertificate(secret.Data[corev1.TLSCertKey])
+	if err != nil || now.Add(rotateBefore).After(cert.NotAfter) {
+		return true
+	}
+	if cert.CheckSignatureFrom(ca) != nil || cert.VerifyHostname(m.dnsNames()[0]) != nil {
+		return true
+	}
+	return false
+}
+
+// issue creates a new serving certificate, along with a new CA when the current one is about
+// to expire. The replaced CA is kept so clients trusting it keep working until it expires.
+func (m *Manager) issue(current map[string][]byte, now time.Time) (map[string][]byte, error) {
+	data := map[string][]byte{}
+	caCert, errCert := parseCertificate(current[caCertKey])
+	caKey, errKey := parsePrivateKey(current[caKeyKey])
+	if errCert == nil && errKey == nil && now.Add(orDefault(m.RotateBefore, defaultRotateBefore)).Before(caCert.NotAfter) {
+		data[caCertKey] = current[caCertKey]
+		data[caKeyKey] = current[caKeyKey]
+		if previous, ok := current[previousCACertKey]; ok {
+			data[previousCACertKey] = previous
+		}
+	} else {
+		previous := caCert
+		var err error
+		caKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		template := &x509.Certificate{
+			SerialNumber:          serialNumber(now),
+			Subject:               pkix.Name{CommonName: m.ServiceName + "-ca"},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(orDefault(m.CAValidity, defaultCAValidity)),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+		if err != nil {
+			return nil, err
+		}
+		if caCert, err = x509.ParseCertificate(der); err != nil {
+			return nil, err
+		}
+		data[caCertKey] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		data[caKeyKey] = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(caKey)})
+		if errCert == nil && now.Before(previous.NotAfter) {
+			data[previousCACertKey] = current[caCertKey]
+		}
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	dnsNames := m.dnsNames()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(now),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(orDefault(m.CertValidity, defaultCertValidity)),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	data[corev1.TLSCertKey] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data[corev1.TLSPrivateKeyKey] = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return data, nil
+}
+
+// dnsNames are the names the API server may use to reach the webhook Service
+func (m *Manager) dnsNames() []string {
+	return []string{
+		fmt.Sprintf("%s.%s.svc", m.ServiceName, m.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", m.ServiceName, m.Namespace),
+		m.ServiceName + "." + m.Namespace,
+	}
+}
+
+// writeCertDir writes the serving certificate for the webhook server, which reloads it on change.
+// Files are replaced by renaming so the server never reads half of one.
+func (m *Manager) writeCertDir(secret *corev1.Secret) error {
+	if err := os.MkdirAll(m.CertDir, 0o700); err != nil {
+		return err
+	}
+	for _, key := range []string{corev1.TLSPrivateKeyKey, corev1.TLSCertKey} {
+		path := filepath.Join(m.CertDir, key)
+		if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, secret.Data[key]) {
+			continue
+		}
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, secret.Data[key], 0o600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// caBundle is the current CA, followed by the replaced one while it is still valid
+func caBundle(secret *corev1.Secret, now time.Time) []byte {
+	bundle := append([]byte(nil), secret.Data[caCertKey]...)
+	if previous, err := parseCertificate(secret.Data[previousCACertKey]); err == nil && now.Before(previous.NotAfter) {
+		bundle = append(bundle, secret.Data[previousCACertKey]...)
+	}
+	return bundle
+}
+
+// injectCABundle sets the CA bundle on the configured webhook configurations and on the
+// conversion webhooks of the configured CRDs
+func (m *Manager) injectCABundle(ctx context.Context, bundle []byte) error {
+	for _, name := range m.MutatingWebhookConfigurations {
+		config := &admissionregistrationv1.MutatingWebhookConfiguration{}
+		found, err := m.get(ctx, name, config)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		changed := false
+		for i := range config.Webhooks {
+			if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, bundle) {
+				config.Webhooks[i].ClientConfig.CABundle = bundle
+				changed = true
+			}
+		}
+		if err := m.update(ctx, config, changed); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range m.ValidatingWebhookConfigurations {
+		config := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+		found, err := m.get(ctx, name, config)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		changed := false
+		for i := range config.Webhooks {
+			if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, bundle) {
+				config.Webhooks[i].ClientConfig.CABundle = bundle
+				changed = true
+			}
+		}
+		if err := m.update(ctx, config, changed); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range m.CustomResourceDefinitions {
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		found, err := m.get(ctx, name, crd)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		// CRDs without a conversion webhook have nothing to trust
+		conversion := crd.Spec.Conversion
+		if conversion == nil || conversion.Strategy != apiextensionsv1.WebhookConverter || conversion.Webhook == nil || conversion.Webhook.ClientConfig == nil {
+			continue
+		}
+		changed := !bytes.Equal(conversion.Webhook.ClientConfig.CABundle, bundle)
+		conversion.Webhook.ClientConfig.CABundle = bundle
+		if err := m.update(ctx, crd, changed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get reads a cluster scoped object, not finding it isn't an error
+func (m *Manager) get(ctx context.Context, name string, obj client.Object) (bool, error) {
+	err := m.Client.Get(ctx, types.NamespacedName{Name: name}, obj)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *Manager) update(ctx context.Context, obj client.Object, changed bool) error {
+	if !changed {
+		return nil
+	}
+	log.Log.Info("injecting webhook CA bundle", "kind", fmt.Sprintf("%T", obj), "name", obj.GetName())
+	return m.Client.Update(ctx, obj)
+}
+
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func serialNumber(now time.Time) *big.Int {
+	return big.NewInt(now.UnixNano())
+}
+
+func orDefault(value, fallback time.Duration) time.Duration {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhookcert
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newManager(t *testing.T, objs ...client.Object) *Manager {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := apiextensionsv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return &Manager{
+		Client:      fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		SecretName:  "webhook-server-cert",
+		Namespace:   "podset-operator-system",
+		ServiceName: "webhook-service",
+		CertDir:     t.TempDir(),
+	}
+}
+
+func storedSecret(t *testing.T, m *Manager) *corev1.Secret {
+	secret := &corev1.Secret{}
+	if err := m.Client.Get(context.Background(), types.NamespacedName{Namespace: m.Namespace, Name: m.SecretName}, secret); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// verify checks the serving certificate is signed by the stored CA for the service's names
+func verify(t *testing.T, secret *corev1.Secret, dnsName string, now time.Time) {
+	ca, err := parseCertificate(secret.Data[caCertKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := parseCertificate(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: dnsName, Roots: roots, CurrentTime: now}); err != nil {
+		t.Errorf("serving certificate doesn't verify: %v", err)
+	}
+}
+
+func TestEnsureIssuesCertificates(t *testing.T) {
+	m := newManager(t)
+	if err := m.Ensure(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	secret := storedSecret(t, m)
+	if secret.Type != corev1.SecretTypeTLS {
+		t.Errorf("Secret type = %s, want %s", secret.Type, corev1.SecretTypeTLS)
+	}
+	for _, name := range m.dnsNames() {
+		verify(t, secret, name, time.Now())
+	}
+	if _, ok := secret.Data[previousCACertKey]; ok {
+		t.Errorf("a first issue has no previous CA")
+	}
+	for _, key := range []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey} {
+		data, err := os.ReadFile(filepath.Join(m.CertDir, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, secret.Data[key]) {
+			t.Errorf("%s in the CertDir differs from the Secret", key)
+		}
+	}
+
+	// a second run keeps what is stored
+	if err := m.Ensure(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storedSecret(t, m).Data[corev1.TLSCertKey], secret.Data[corev1.TLSCertKey]) {
+		t.Errorf("a valid certificate was issued again")
+	}
+}
+
+func TestEnsureSecretRotates(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		name       string
+		after      time.Duration
+		rotateCert bool
+		rotateCA   bool
+	}{
+		{name: "fresh", after: day},
+		{name: "serving certificate outside the window", after: defaultCertValidity - 31*day},
+		{name: "serving certificate inside the window", after: defaultCertValidity - 29*day, rotateCert: true},
+		{name: "CA inside the window", after: defaultCAValidity - 29*day, rotateCert: true, rotateCA: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			m := newManager(t)
+			issued := time.Now()
+			first, err := m.ensureSecret(ctx, issued)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := issued.Add(tt.after)
+			second, err := m.ensureSecret(ctx, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rotated := !bytes.Equal(first.Data[corev1.TLSCertKey], second.Data[corev1.TLSCertKey]); rotated != tt.rotateCert {
+				t.Errorf("serving certificate rotated = %v, want %v", rotated, tt.rotateCert)
+			}
+			if rotated := !bytes.Equal(first.Data[caCertKey], second.Data[caCertKey]); rotated != tt.rotateCA {
+				t.Errorf("CA rotated = %v, want %v", rotated, tt.rotateCA)
+			}
+			verify(t, second, m.dnsNames()[0], now)
+
+			// the replaced CA stays trusted until it expires
+			bundle := caBundle(second, now)
+			if tt.rotateCA {
+				if !bytes.Equal(second.Data[previousCACertKey], first.Data[caCertKey]) {
+					t.Errorf("the replaced CA wasn't kept")
+				}
+				if !bytes.Contains(bundle, first.Data[caCertKey]) || !bytes.Contains(bundle, second.Data[caCertKey]) {
+					t.Errorf("CA bundle should hold both CAs")
+				}
+				if expired := caBundle(second, issued.Add(defaultCAValidity+day)); !bytes.Equal(expired, second.Data[caCertKey]) {
+					t.Errorf("an expired CA is still in the bundle")
+				}
+			} else if !bytes.Equal(bundle, second.Data[caCertKey]) {
+				t.Errorf("CA bundle should only hold the current CA")
+			}
+		})
+	}
+}
+
+func TestInjectCABundle(t *testing.T) {
+	ctx := context.Background()
+	webhook := func(name string) admissionregistrationv1.WebhookClientConfig {
+		return admissionregistrationv1.WebhookClientConfig{Service: &admissionregistrationv1.ServiceReference{Name: name}}
+	}
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "mutating"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "a.podsets.app.github.com", ClientConfig: webhook("a")},
+			{Name: "b.podsets.app.github.com", ClientConfig: webhook("b")},
+		},
+	}
+	validating := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "validating"},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{Name: "a.podsets.app.github.com", ClientConfig: webhook("a")},
+		},
+	}
+	converted := &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "converted"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Conversion: &apiextensionsv1.CustomResourceConversion{
+				Strategy: apiextensionsv1.WebhookConverter,
+				Webhook: &apiextensionsv1.WebhookConversion{
+					ClientConfig: &apiextensionsv1.WebhookClientConfig{Service: &apiextensionsv1.ServiceReference{Name: "a"}},
+				},
+			},
+		},
+	}
+	plain := &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "plain"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Conversion: &apiextensionsv1.CustomResourceConversion{Strategy: apiextensionsv1.NoneConverter},
+		},
+	}
+	m := newManager(t, mutating, validating, converted, plain)
+	m.MutatingWebhookConfigurations = []string{"mutating", "missing"}
+	m.ValidatingWebhookConfigurations = []string{"validating"}
+	m.CustomResourceDefinitions = []string{"converted", "plain", "missing"}
+
+	bundle := []byte("bundle")
+	if err := m.injectCABundle(ctx, bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Client.Get(ctx, client.ObjectKeyFromObject(mutating), mutating); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range mutating.Webhooks {
+		if !bytes.Equal(w.ClientConfig.CABundle, bundle) {
+			t.Errorf("mutating webhook %s has CA bundle %q", w.Name, w.ClientConfig.CABundle)
+		}
+	}
+	if err := m.Client.Get(ctx, client.ObjectKeyFromObject(validating), validating); err != nil {
+		t.Fatal(err)
+	}
+	if got := validating.Webhooks[0].ClientConfig.CABundle; !bytes.Equal(got, bundle) {
+		t.Errorf("validating webhook has CA bundle %q", got)
+	}
+	if err := m.Client.Get(ctx, client.ObjectKeyFromObject(converted), converted); err != nil {
+		t.Fatal(err)
+	}
+	if got := converted.Spec.Conversion.Webhook.ClientConfig.CABundle; !bytes.Equal(got, bundle) {
+		t.Errorf("conversion webhook has CA bundle %q", got)
+	}
+	if err := m.Client.Get(ctx, client.ObjectKeyFromObject(plain), plain); err != nil {
+		t.Fatal(err)
+	}
+	if plain.Spec.Conversion.Webhook != nil {
+		t.Errorf("a CRD without conversion webhook was given one")
+	}
+
+	// nothing changes, nothing is written
+	version := mutating.ResourceVersion
+	if err := m.injectCABundle(ctx, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Client.Get(ctx, client.ObjectKeyFromObject(mutating), mutating); err != nil {
+		t.Fatal(err)
+	}
+	if mutating.ResourceVersion != version {
+		t.Errorf("an unchanged webhook configuration was updated")
+	}
+}